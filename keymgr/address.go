@@ -0,0 +1,91 @@
+package keymgr
+
+import (
+	"net/mail"
+	"strings"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"code.google.com/p/go.net/idna"
+)
+
+const subaddressSeparator = "+"
+
+// SetSubaddressMatching enables or disables looking up the keys of the base
+// address for addresses with a "+tag" subaddress, such as
+// user+tag@example.com, which have no keys of their own.
+func SetSubaddressMatching(enabled bool) {
+	defaultKeys.setSubaddressMatching(enabled)
+}
+
+func (store *keyStore) setSubaddressMatching(enabled bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.matchSubaddresses = enabled
+	store.publicIndex.matchSubaddresses = enabled
+	store.secretIndex.matchSubaddresses = enabled
+}
+
+// normalizeEmail returns the form of an e-mail address used for lookups.
+// Display names, angle brackets and surrounding space are removed, the
+// address is folded to lower case and international domain names are
+// converted to their ASCII form. The local part is folded as well since
+// mail systems treat it case insensitively in practice.
+func normalizeEmail(address string) string {
+	addr := parseAddress(address)
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return strings.ToLower(addr)
+	}
+	return strings.ToLower(addr[:at]) + "@" + domainToASCII(addr[at+1:])
+}
+
+// parseAddress returns the bare address of an address which may have a
+// display name, as in a To: header, or be enclosed in angle brackets.
+func parseAddress(address string) string {
+	s := strings.TrimSpace(address)
+	if a, err := mail.ParseAddress(s); err == nil {
+		return a.Address
+	}
+	if i, j := strings.LastIndex(s, "<"), strings.LastIndex(s, ">"); i >= 0 && j > i {
+		s = s[i+1 : j]
+	}
+	return strings.TrimSpace(s)
+}
+
+// baseAddress returns a normalized address with its subaddress removed.
+func baseAddress(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	if i := strings.Index(email[:at], subaddressSeparator); i > 0 {
+		return email[:i] + email[at:]
+	}
+	return email
+}
+
+// userIdEmail returns the e-mail address of uid. The openpgp package only
+// splits user ids of the form "name (comment) <email>", user ids which
+// consist of a bare address or which it leaves unsplit otherwise are
+// parsed here.
+func userIdEmail(uid *packet.UserId) string {
+	if uid.Email != "" {
+		return uid.Email
+	}
+	if addr := parseAddress(uid.Id); strings.Contains(addr, "@") && !strings.ContainsAny(addr, " \t") {
+		return addr
+	}
+	return ""
+}
+
+// domainToASCII converts a domain name to lower case and its international
+// labels to punycode, RFC 3490. Case folding stands in for the full
+// nameprep profile. A domain which cannot be converted is only folded.
+func domainToASCII(domain string) string {
+	domain = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(domain)
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if a, err := idna.ToASCII(domain); err == nil {
+		return a
+	}
+	return domain
+}
@@ -0,0 +1,58 @@
+package keymgr
+
+import (
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	for _, test := range []struct{ in, out string }{
+		{"alice@example.com", "alice@example.com"},
+		{" Alice@Example.COM ", "alice@example.com"},
+		{"<alice@example.com>", "alice@example.com"},
+		{"Alice Smith <Alice@example.com>", "alice@example.com"},
+		{`"Smith, Alice" <alice@example.com>`, "alice@example.com"},
+		{"alice@bücher.example", "alice@xn--bcher-kva.example"},
+		{"alice@MÜNCHEN.de.", "alice@xn--mnchen-3ya.de"},
+		{"alice@例え。テスト", "alice@xn--r8jz45g.xn--zckzah"},
+	} {
+		if got := normalizeEmail(test.in); got != test.out {
+			t.Errorf("normalizeEmail(%q) = %q, expecting %q", test.in, got, test.out)
+		}
+	}
+}
+
+func TestUnsplitUserIdEmail(t *testing.T) {
+	for _, test := range []struct{ id, email string }{
+		{"alice@example.com", "alice@example.com"},
+		{"<alice@example.com>", "alice@example.com"},
+		{"Alice Smith", ""},
+	} {
+		uid := &packet.UserId{Id: test.id, Name: test.id}
+		if got := userIdEmail(uid); got != test.email {
+			t.Errorf("userIdEmail(%q) = %q, expecting %q", test.id, got, test.email)
+		}
+	}
+}
+
+func TestSubaddressLookup(t *testing.T) {
+	el := syntheticKeyring(2)
+	uid := &packet.UserId{Id: "user9@example.com", Name: "user9@example.com"}
+	el[1].Identities = map[string]*openpgp.Identity{uid.Id: {Name: uid.Id, UserId: uid}}
+	idx := newKeyIndex(el)
+	if got := idx.lookupEmail("User 0 <USER0@example.com>"); len(got) != 1 || got[0] != el[0] {
+		t.Errorf("lookup with display name returned %v", got)
+	}
+	if got := idx.lookupEmail("user9@Example.com"); len(got) != 1 || got[0] != el[1] {
+		t.Errorf("lookup of bare address user id returned %v", got)
+	}
+	if got := idx.lookupEmail("user0+lists@example.com"); len(got) != 0 {
+		t.Errorf("subaddress matched with matching disabled: %v", got)
+	}
+	idx.matchSubaddresses = true
+	if got := idx.lookupEmail("user0+lists@example.com"); len(got) != 1 || got[0] != el[0] {
+		t.Errorf("subaddress lookup returned %v", got)
+	}
+}
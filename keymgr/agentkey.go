@@ -0,0 +1,386 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/elgamal"
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"code.google.com/p/go.crypto/openpgp/s2k"
+)
+
+// The protection modes of gpg-agent are AES-128 in CBC mode, used before
+// 2.3, and AES-128 in OCB mode, the default since 2.3. Both are keyed with
+// an OpenPGP iterated and salted S2K over SHA-1.
+const (
+	agentProtectionCBC = "openpgp-s2k3-sha1-aes-cbc"
+	agentProtectionOCB = "openpgp-s2k3-ocb-aes"
+)
+
+// agentOCBNonceSize is the size of the nonce gpg-agent uses in OCB mode.
+const agentOCBNonceSize = 12
+
+var errWrongPassphrase = errors.New("wrong passphrase")
+
+// agentKey is a secret key stored by gpg-agent as an S-expression in the
+// private-keys-v1.d directory of a GnuPG 2.1+ home directory.
+type agentKey struct {
+	path      string
+	algo      string
+	params    *sexp
+	protected bool
+}
+
+// loadAgentSecretKeys builds secret entities for every entity in pub for
+// which the primary secret key is stored in dir. The agent keys of locked
+// secret keys are recorded in the extras of the entities.
+func loadAgentSecretKeys(dir string, pub openpgp.EntityList, r *loadReport) (openpgp.EntityList, error) {
+	keys, err := readAgentKeyDirectory(dir, r)
+	if err != nil {
+		return nil, err
+	}
+	sec := openpgp.EntityList{}
+	if len(keys) == 0 {
+		return sec, nil
+	}
+	for _, e := range pub {
+		x := &keyExtras{}
+		priv := agentPrivateKeyFor(keys, e.PrimaryKey, x)
+		if priv == nil {
+			continue
+		}
+		se := &openpgp.Entity{
+			PrimaryKey:  &priv.PublicKey,
+			PrivateKey:  priv,
+			Identities:  e.Identities,
+			Revocations: e.Revocations,
+		}
+		for _, sk := range e.Subkeys {
+			if sk.PrivateKey = agentPrivateKeyFor(keys, sk.PublicKey, x); sk.PrivateKey != nil {
+				sk.PublicKey = &sk.PrivateKey.PublicKey
+			}
+			se.Subkeys = append(se.Subkeys, sk)
+		}
+		if len(x.agentKeys) > 0 {
+			r.addExtras(se, x)
+		}
+		sec = append(sec, se)
+	}
+	return sec, nil
+}
+
+// agentPrivateKeyFor returns the secret key for pub from keys, or nil if
+// there is none. The agent key of a locked secret key is added to x.
+func agentPrivateKeyFor(keys []*agentKey, pub *packet.PublicKey, x *keyExtras) *packet.PrivateKey {
+	for _, ak := range keys {
+		if !ak.matches(pub) {
+			continue
+		}
+		priv, err := ak.privateKey(pub)
+		if err != nil {
+			logger.Warningf("Cannot use secret key %s: %v", ak.path, err)
+			return nil
+		}
+		if priv.Encrypted {
+			if x.agentKeys == nil {
+				x.agentKeys = make(map[[20]byte]*agentKey)
+			}
+			x.agentKeys[pub.Fingerprint] = ak
+		}
+		return priv
+	}
+	return nil
+}
+
+func readAgentKeyDirectory(dir string, r *loadReport) ([]*agentKey, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys []*agentKey
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".key") {
+			continue
+		}
+		path := filepath.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		ak, err := parseAgentKey(data)
+		if err != nil {
+			r.skip(path, 0, [20]byte{}, err)
+			continue
+		}
+		if ak != nil {
+			ak.path = path
+			keys = append(keys, ak)
+		}
+	}
+	return keys, nil
+}
+
+// parseAgentKey parses a key file in either the canonical S-expression
+// format or the extended name-value format. It returns nil for keys
+// which are only references to a smartcard.
+func parseAgentKey(data []byte) (*agentKey, error) {
+	if len(data) > 0 && data[0] != '(' {
+		v, err := extendedKeyValue(data)
+		if err != nil {
+			return nil, err
+		}
+		data = v
+	}
+	s, err := parseSexp(data)
+	if err != nil {
+		return nil, err
+	}
+	ak := &agentKey{}
+	switch s.name() {
+	case "private-key":
+	case "protected-private-key":
+		ak.protected = true
+	case "shadowed-private-key":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown key type %q", s.name())
+	}
+	if len(s.list) < 2 || s.list[1].name() == "" {
+		return nil, errors.New("missing key parameters")
+	}
+	ak.params = s.list[1]
+	ak.algo = ak.params.name()
+	return ak, nil
+}
+
+// extendedKeyValue returns the value of the Key: entry of a key file in
+// the extended format, joining any continuation lines.
+func extendedKeyValue(data []byte) ([]byte, error) {
+	var value []byte
+	inKey := false
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if inKey {
+				value = append(append(value, '\n'), line...)
+			}
+			continue
+		}
+		inKey = len(line) >= 4 && strings.EqualFold(string(line[:4]), "key:")
+		if inKey {
+			value = append(value, line[4:]...)
+		}
+	}
+	if value == nil {
+		return nil, errors.New("no Key: entry in extended key file")
+	}
+	return value, nil
+}
+
+// matches returns true if the public parameters of ak are those of pub.
+func (ak *agentKey) matches(pub *packet.PublicKey) bool {
+	switch k := pub.PublicKey.(type) {
+	case *rsa.PublicKey:
+		n := ak.params.mpi("n")
+		return ak.algo == "rsa" && n != nil && n.Cmp(k.N) == 0
+	case *dsa.PublicKey:
+		y := ak.params.mpi("y")
+		return ak.algo == "dsa" && y != nil && y.Cmp(k.Y) == 0
+	case *elgamal.PublicKey:
+		y := ak.params.mpi("y")
+		return ak.algo == "elg" && y != nil && y.Cmp(k.Y) == 0
+	case *ecdsa.PublicKey:
+		q := ak.params.value("q")
+		return (ak.algo == "ecc" || ak.algo == "ecdsa") && pub.PubKeyAlgo == packet.PubKeyAlgoECDSA &&
+			bytes.Equal(q, elliptic.Marshal(k.Curve, k.X, k.Y))
+	}
+	return false
+}
+
+// privateKey returns the secret key for pub. Protected keys are returned
+// locked and are unlocked with ak by UnlockPrivateKey.
+func (ak *agentKey) privateKey(pub *packet.PublicKey) (*packet.PrivateKey, error) {
+	if ak.protected {
+		return newLockedStub(pub)
+	}
+	priv := &packet.PrivateKey{PublicKey: *pub}
+	k, err := agentSecretKeyMaterial(ak.algo, pub, ak.params)
+	if err != nil {
+		return nil, err
+	}
+	priv.PrivateKey = k
+	return priv, nil
+}
+
+// unlock decrypts the secret parameters of ak and stores them in pk.
+func (ak *agentKey) unlock(pk *packet.PrivateKey, passphrase []byte) error {
+	secret, err := ak.decrypt(passphrase)
+	if err != nil {
+		return err
+	}
+	k, err := agentSecretKeyMaterial(ak.algo, &pk.PublicKey, secret)
+	if err != nil {
+		return errWrongPassphrase
+	}
+	pk.PrivateKey = k
+	pk.Encrypted = false
+	return nil
+}
+
+// decrypt returns the S-expression holding the secret parameters of a
+// protected key. The layout of the protected list is
+//
+//	(protected MODE ((sha1 SALT COUNT) IV) CIPHERTEXT)
+//
+// In OCB mode IV is the nonce, CIPHERTEXT ends with the tag and the
+// associated data is the key with the protected list left out.
+func (ak *agentKey) decrypt(passphrase []byte) (*sexp, error) {
+	prot := ak.params.find("protected")
+	if prot == nil || len(prot.list) != 4 {
+		return nil, errors.New("malformed protected key")
+	}
+	mode := string(prot.list[1].atom)
+	if mode != agentProtectionCBC && mode != agentProtectionOCB {
+		return nil, fmt.Errorf("unsupported key protection %q", mode)
+	}
+	parms := prot.list[2]
+	if !parms.isList || len(parms.list) != 2 || !parms.list[0].isList || len(parms.list[0].list) != 3 {
+		return nil, errors.New("malformed protection parameters")
+	}
+	salt := parms.list[0].list[1].atom
+	count, err := strconv.Atoi(string(parms.list[0].list[2].atom))
+	if err != nil {
+		return nil, fmt.Errorf("malformed S2K count: %v", err)
+	}
+	iv := parms.list[1].atom
+	ciphertext := prot.list[3].atom
+	if mode == agentProtectionCBC && (len(iv) != aes.BlockSize || len(ciphertext)%aes.BlockSize != 0) ||
+		mode == agentProtectionOCB && (len(iv) != agentOCBNonceSize || len(ciphertext) < ocbTagSize) {
+		return nil, errors.New("malformed protected key data")
+	}
+
+	key := make([]byte, 16)
+	s2k.Iterated(key, sha1.New(), passphrase, salt, count)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	var plaintext []byte
+	if mode == agentProtectionOCB {
+		if plaintext, err = newOCB(block).open(iv, ciphertext, ak.protectedData(prot)); err != nil {
+			return nil, errWrongPassphrase
+		}
+	} else {
+		plaintext = make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	}
+	secret, err := parseSexp(plaintext)
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return secret, nil
+}
+
+// protectedData returns the data authenticated along with the secret
+// parameters in OCB mode, the canonical encoding of the key parameters
+// without the protected list prot.
+func (ak *agentKey) protectedData(prot *sexp) []byte {
+	params := &sexp{isList: true}
+	for _, v := range ak.params.list {
+		if v != prot {
+			params.list = append(params.list, v)
+		}
+	}
+	return params.canonical()
+}
+
+// agentSecretKeyMaterial builds the private key for pub from the secret
+// parameters in secret and checks that they belong to pub.
+func agentSecretKeyMaterial(algo string, pub *packet.PublicKey, secret *sexp) (interface{}, error) {
+	invalid := fmt.Errorf("invalid %s secret key parameters", algo)
+	switch k := pub.PublicKey.(type) {
+	case *rsa.PublicKey:
+		d, p, q := secret.mpi("d"), secret.mpi("p"), secret.mpi("q")
+		if d == nil || p == nil || q == nil {
+			return nil, invalid
+		}
+		// OpenPGP and libgcrypt both require p < q, Go stores them as q, p
+		priv := &rsa.PrivateKey{PublicKey: *k, D: d, Primes: []*big.Int{q, p}}
+		if priv.Validate() != nil {
+			return nil, invalid
+		}
+		priv.Precompute()
+		return priv, nil
+	case *dsa.PublicKey:
+		x := secret.mpi("x")
+		if x == nil || new(big.Int).Exp(k.G, x, k.P).Cmp(k.Y) != 0 {
+			return nil, invalid
+		}
+		return &dsa.PrivateKey{PublicKey: *k, X: x}, nil
+	case *elgamal.PublicKey:
+		x := secret.mpi("x")
+		if x == nil || new(big.Int).Exp(k.G, x, k.P).Cmp(k.Y) != 0 {
+			return nil, invalid
+		}
+		return &elgamal.PrivateKey{PublicKey: *k, X: x}, nil
+	case *ecdsa.PublicKey:
+		d := secret.mpi("d")
+		if d == nil {
+			return nil, invalid
+		}
+		x, y := k.Curve.ScalarBaseMult(d.Bytes())
+		if x.Cmp(k.X) != 0 || y.Cmp(k.Y) != 0 {
+			return nil, invalid
+		}
+		return &ecdsa.PrivateKey{PublicKey: *k, D: d}, nil
+	}
+	return nil, fmt.Errorf("unsupported key algorithm %q", algo)
+}
+
+// newLockedStub returns an encrypted secret key packet for pub which
+// carries no usable key material. The openpgp package can only decrypt
+// keys it has parsed, so this gives locked gpg-agent keys a well formed
+// representation that simply fails to decrypt with any passphrase.
+func newLockedStub(pub *packet.PublicKey) (*packet.PrivateKey, error) {
+	body, err := publicKeyBody(pub)
+	if err != nil {
+		return nil, err
+	}
+	b := bytes.NewBuffer(body)
+	// s2k usage 254, AES-128, iterated and salted S2K with SHA-1
+	b.Write([]byte{254, byte(packet.CipherAES128), 3, 2})
+	random := make([]byte, 8+1+aes.BlockSize+32)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return nil, err
+	}
+	random[8] = 0x60
+	b.Write(random)
+
+	tag := byte(tagSecretKey)
+	if pub.IsSubkey {
+		tag = tagSecretSubkey
+	}
+	pkt := &bytes.Buffer{}
+	if err := writePacket(pkt, tag, b.Bytes()); err != nil {
+		return nil, err
+	}
+	return readPrivateKeyPacket(pkt.Bytes())
+}
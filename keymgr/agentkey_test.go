@@ -0,0 +1,200 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha1"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"code.google.com/p/go.crypto/openpgp/s2k"
+)
+
+func TestParseSexp(t *testing.T) {
+	s, err := parseSexp([]byte(`(private-key (rsa (n #00C1#) (e "\x01") (d |AQAB|) (5:label3:abc)))`))
+	if err != nil {
+		t.Fatalf("error parsing S-expression: %v", err)
+	}
+	if s.name() != "private-key" {
+		t.Errorf("unexpected list name %q", s.name())
+	}
+	if n := s.mpi("n"); n == nil || n.Int64() != 0xc1 {
+		t.Errorf("unexpected value of n: %v", n)
+	}
+	if e := s.value("e"); !bytes.Equal(e, []byte{1}) {
+		t.Errorf("unexpected value of e: %x", e)
+	}
+	if d := s.value("d"); !bytes.Equal(d, []byte{1, 0, 1}) {
+		t.Errorf("unexpected value of d: %x", d)
+	}
+	if l := s.value("label"); string(l) != "abc" {
+		t.Errorf("unexpected value of label: %q", l)
+	}
+}
+
+func TestUnprotectedAgentKey(t *testing.T) {
+	priv, pub := testRSAKey(t)
+	ak, err := parseAgentKey([]byte(fmt.Sprintf("(private-key (rsa %s%s))", rsaPublicParams(priv), rsaSecretParams(priv))))
+	if err != nil {
+		t.Fatalf("error parsing agent key: %v", err)
+	}
+	if !ak.matches(pub) {
+		t.Fatal("agent key does not match its public key")
+	}
+	pk, err := ak.privateKey(pub)
+	if err != nil {
+		t.Fatalf("error building private key: %v", err)
+	}
+	if pk.Encrypted || pk.PrivateKey.(*rsa.PrivateKey).D.Cmp(priv.D) != 0 {
+		t.Error("unprotected agent key not loaded as expected")
+	}
+}
+
+func TestProtectedAgentKey(t *testing.T) {
+	priv, pub := testRSAKey(t)
+	salt := []byte("saltsalt")
+	iv := []byte("0123456789abcdef")
+	plain := []byte(fmt.Sprintf("((%s)(4:hash4:sha120:aaaaaaaaaaaaaaaaaaaa))", rsaSecretParams(priv)))
+	plain = append(plain, bytes.Repeat([]byte{0}, aes.BlockSize-len(plain)%aes.BlockSize)...)
+	key := make([]byte, 16)
+	s2k.Iterated(key, sha1.New(), []byte("password"), salt, 65536)
+	block, _ := aes.NewCipher(key)
+	ciphertext := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plain)
+
+	keyfile := fmt.Sprintf("Created: 20150101T000000\nKey: (protected-private-key (rsa %s\n (protected %s ((sha1 #%x# \"65536\") #%x#) #%x#)))\n",
+		rsaPublicParams(priv), agentProtectionCBC, salt, iv, ciphertext)
+	ak, err := parseAgentKey([]byte(keyfile))
+	if err != nil {
+		t.Fatalf("error parsing extended key file: %v", err)
+	}
+	pk, err := ak.privateKey(pub)
+	if err != nil {
+		t.Fatalf("error building private key: %v", err)
+	}
+	if !pk.Encrypted {
+		t.Fatal("protected agent key is not reported as encrypted")
+	}
+	x := &keyExtras{agentKeys: map[[20]byte]*agentKey{pub.Fingerprint: ak}}
+	if err := decryptPrivateKey(pk, x, []byte("wrong")); err == nil {
+		t.Error("unlocking agent key with incorrect passphrase did not fail")
+	}
+	if err := decryptPrivateKey(pk, x, []byte("password")); err != nil {
+		t.Fatalf("unlocking agent key failed: %v", err)
+	}
+	if pk.Encrypted || pk.PrivateKey.(*rsa.PrivateKey).D.Cmp(priv.D) != 0 {
+		t.Error("unlocked agent key does not contain the expected key material")
+	}
+}
+
+// ocbAgentKey is a key protected with the passphrase "password" by
+// gpg-agent in OCB mode, and ocbAgentPublicKey its public key.
+const ocbAgentKey = `Created: 20261016T170238
+Key: (protected-private-key (rsa (n #00C4A3408285F5A3BA31A382B582F55BE6
+ 848E444D06E23A02E25EC6D36CA6E10FA1A7E288BA7277E8FBC8B9356CADC0F0538B8C
+ 20898BAC184E4BF828751E82C80BAE0D4D502A62714204CE7F4A4D12E7DEE60E3EEA3D
+ 7351B9584E40DC7D294075F1C384CA62E92A95630266AD80677E0E392B27AF0FF4D183
+ 3918F50C08AC91#)(e #010001#)(protected openpgp-s2k3-ocb-aes ((sha1
+  #D65B3F22344964B3# "117049344")#E5D923C8FD9BCB9B8C462534#)#B2959AA4B2
+ 64EAB0D424D5C3B32D48CA558D22462424CA4F7C567866F9C26153059DF849541C276F
+ D6BDC3A668410E880CACED1E635AB611F318E436232C263C8E3C3952A8DC976D026A31
+ 59390F0138E056AC9C943B1373CD4EDF3DEBCAE00F4B87170490831580F3ED92671F10
+ F6572DE5E0FDE68B32F16ED7F5D54F6E067E309B042091481D9A0F3EBFBD6AE91E44A1
+ DCE333A2E1500C31B1840B6F945C8DBB6443A519474329586956BB0460111B65F777E1
+ B1580D57F22D4E84D4946827E8CEE3AFAF7D2465C110E38B50EB5E64C36DA5E3DAF823
+ B9F116CEC50659F73F6DEB4C22C156B7348FD9559D318381BD8B6BE980FEC996FD27C1
+ F5D98CAAF764974BB605FA3B853EDEB0948A7026481D129B23D6738CD771CB0FB48818
+ C9ACB2817CDAF0EAB3A86A45A43156D16941C5E5EA53D5619D13EB7EE4DEB79978455C
+ 5A07CE9F586A8420CCB5CB11B24B04EBD24267CDF59C381057F17E30828331B8AD1AEE
+ 1AD8217767AB418209AE32ACE2CCC4F7A22BFD30#)(protected-at
+  "20261016T170238")))
+`
+
+const ocbAgentPublicKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+
+mI0EatJYrgEEAMSjQIKF9aO6MaOCtYL1W+aEjkRNBuI6AuJextNspuEPoafiiLpy
+d+j7yLk1bK3A8FOLjCCJi6wYTkv4KHUegsgLrg1NUCpicUIEzn9KTRLn3uYOPuo9
+c1G5WE5A3H0pQHXxw4TKYukqlWMCZq2AZ34OOSsnrw/00YM5GPUMCKyRABEBAAG0
+Gk9DQiBUZXN0IDxvY2JAZXhhbXBsZS5jb20+iM4EEwEKADgWIQQwfcZ8mSNE/ZrI
+j2p3b/HtwW7cDgUCatJYrgIbAwULCQgHAgYVCgkICwIEFgIDAQIeAQIXgAAKCRB3
+b/HtwW7cDnvAA/0X8yScfTiI4n3kdsj0Pi6y1tn5Z1DSJHjAx64P7KzxGoOcrT+2
+NlL0VUywUWfWAxs6U991Skc5bzgc4OtUArzJDd9VdLKd6BgsO9bymmDMBuFqjs6R
+XMskVgZtitfC2IJHKsYj7ErvXjTIOKGOyMeJvT9P7Y3ix/cvSPWeQYSUNA==
+=YUNz
+-----END PGP PUBLIC KEY BLOCK-----
+`
+
+func TestOCBProtectedAgentKey(t *testing.T) {
+	el, err := openpgp.ReadArmoredKeyRing(strings.NewReader(ocbAgentPublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := el[0].PrimaryKey
+	ak, err := parseAgentKey([]byte(ocbAgentKey))
+	if err != nil {
+		t.Fatalf("error parsing OCB protected key file: %v", err)
+	}
+	if !ak.matches(pub) {
+		t.Fatal("agent key does not match its public key")
+	}
+	pk, err := ak.privateKey(pub)
+	if err != nil {
+		t.Fatalf("error building private key: %v", err)
+	}
+	x := &keyExtras{agentKeys: map[[20]byte]*agentKey{pub.Fingerprint: ak}}
+	if err := decryptPrivateKey(pk, x, []byte("wrong")); err != errWrongPassphrase {
+		t.Errorf("unlocking agent key with incorrect passphrase returned %v", err)
+	}
+	if err := decryptPrivateKey(pk, x, []byte("password")); err != nil {
+		t.Fatalf("unlocking agent key failed: %v", err)
+	}
+	if pk.Encrypted {
+		t.Error("OCB protected agent key not unlocked")
+	}
+}
+
+func TestUnsupportedAgentProtection(t *testing.T) {
+	priv, pub := testRSAKey(t)
+	keyfile := fmt.Sprintf("(protected-private-key (rsa %s (protected openpgp-s2k3-sha1-aes256-cbc ((sha1 #0102030405060708# \"65536\") #%x#) #%x#)))",
+		rsaPublicParams(priv), make([]byte, 16), make([]byte, 32))
+	ak, err := parseAgentKey([]byte(keyfile))
+	if err != nil {
+		t.Fatalf("error parsing agent key: %v", err)
+	}
+	pk, err := ak.privateKey(pub)
+	if err != nil {
+		t.Fatalf("error building private key: %v", err)
+	}
+	x := &keyExtras{agentKeys: map[[20]byte]*agentKey{pub.Fingerprint: ak}}
+	if err := decryptPrivateKey(pk, x, []byte("password")); err == nil || err == errWrongPassphrase {
+		t.Errorf("unsupported protection reported as %v", err)
+	}
+}
+
+func testRSAKey(t *testing.T) (*rsa.PrivateKey, *packet.PublicKey) {
+	priv, err := rsa.GenerateKey(openpgpTestConfig().Random(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, packet.NewRSAPublicKey(time.Unix(0, 0), &priv.PublicKey)
+}
+
+func rsaPublicParams(k *rsa.PrivateKey) string {
+	return fmt.Sprintf("(n #00%x#)(e #%x#)", k.N.Bytes(), big.NewInt(int64(k.E)).Bytes())
+}
+
+func rsaSecretParams(k *rsa.PrivateKey) string {
+	p, q := k.Primes[0], k.Primes[1]
+	if p.Cmp(q) > 0 {
+		p, q = q, p
+	}
+	u := new(big.Int).ModInverse(p, q)
+	return fmt.Sprintf("(d #%x#)(p #%x#)(q #%x#)(u #%x#)", k.D.Bytes(), p.Bytes(), q.Bytes(), u.Bytes())
+}
@@ -0,0 +1,260 @@
+package keymgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// CompactKeyrings rewrites the nyms keyring files so that each key is
+// stored only once, merging all copies of a key and dropping superseded
+// self signatures. It returns the number of packets removed. Compaction
+// works on the raw packets, so packets which cannot be parsed are kept.
+func CompactKeyrings() (int, error) {
+	removed := 0
+	err := defaultKeys.update(func(store *keyStore) error {
+		for _, secret := range []bool{false, true} {
+			n, err := compactKeyringFile(keyringFilename(secret), secret)
+			removed += n
+			if err != nil {
+				return err
+			}
+		}
+		if removed == 0 {
+			return nil
+		}
+		return store.reloadNyms()
+	})
+	return removed, err
+}
+
+// reloadNyms reads the nyms keyrings again after they were rewritten, the
+// write lock must be held.
+func (store *keyStore) reloadNyms() error {
+	r := &loadReport{}
+	pub, sec, err := loadNymsKeyrings(r)
+	if err != nil {
+		return err
+	}
+	carryUnlockedKeys(store.secretKeys, sec)
+	store.nyms = keyring{pub, sec, r.extras, r.diagnostics}
+	store.rebuild()
+	return nil
+}
+
+func compactKeyringFile(fname string, secret bool) (int, error) {
+	unlock, err := lockFile(nymsPath(lockFilename))
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	path := nymsPath(fname)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	blocks, err := splitKeyBlocks(data)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	compacted, removed := compactKeyBlocks(blocks)
+	if removed == 0 {
+		return 0, nil
+	}
+	if err := writeFileAtomic(path, compacted, keyringFileMode(secret)); err != nil {
+		return 0, err
+	}
+	logger.Infof("Removed %d packets from %s", removed, path)
+	return removed, nil
+}
+
+// keySection is a key, user id or user attribute packet of a key block
+// together with the signatures and other packets following it.
+type keySection struct {
+	// id identifies the same section in different copies of a key
+	id      string
+	tag     byte
+	pkt     []byte
+	packets [][]byte
+}
+
+// compactKeyBlocks merges all blocks of the same key and returns the
+// resulting keyring along with the number of packets removed. Blocks whose
+// fingerprint cannot be determined are kept unchanged in their place.
+func compactKeyBlocks(blocks []keyBlock) ([]byte, int) {
+	var order []keyBlock
+	keys := make(map[[20]byte][]*keySection)
+	removed := 0
+	for _, kb := range blocks {
+		if kb.fingerprint == ([20]byte{}) {
+			order = append(order, kb)
+			continue
+		}
+		sections, n := splitSections(kb.data)
+		removed += n
+		if _, ok := keys[kb.fingerprint]; !ok {
+			order = append(order, kb)
+		}
+		keys[kb.fingerprint] = mergeSections(keys[kb.fingerprint], sections)
+	}
+	b := &bytes.Buffer{}
+	for _, kb := range order {
+		if kb.fingerprint == ([20]byte{}) {
+			b.Write(kb.data)
+			continue
+		}
+		keyId := binary.BigEndian.Uint64(kb.fingerprint[12:])
+		for _, s := range keys[kb.fingerprint] {
+			s.packets = pruneSelfSignatures(s.tag, s.packets, keyId)
+			b.Write(s.pkt)
+			removed--
+			for _, p := range s.packets {
+				b.Write(p)
+				removed--
+			}
+		}
+	}
+	return b.Bytes(), removed
+}
+
+// splitSections splits a key block into sections and returns them along
+// with the number of packets in the block. Damaged packet framing ends
+// the block.
+func splitSections(data []byte) ([]*keySection, int) {
+	var sections []*keySection
+	n := 0
+	for off := 0; off < len(data); n++ {
+		tag, body, length, err := nextPacket(data[off:])
+		if err != nil {
+			break
+		}
+		pkt := data[off : off+length]
+		off += length
+		switch tag {
+		case tagPublicKey, tagSecretKey, tagPublicSubkey, tagSecretSubkey, tagUserId, tagUserAttribute:
+			sections = append(sections, &keySection{id: sectionId(tag, body, pkt), tag: tag, pkt: pkt})
+		default:
+			if len(sections) == 0 {
+				sections = append(sections, &keySection{id: sectionId(tag, body, pkt), tag: tag, pkt: pkt})
+				continue
+			}
+			s := sections[len(sections)-1]
+			s.packets = append(s.packets, pkt)
+		}
+	}
+	return sections, n
+}
+
+// sectionId returns the id of the section starting with the packet pkt.
+// Keys are identified by their fingerprint, user ids and user attributes
+// by their content.
+func sectionId(tag byte, body, pkt []byte) string {
+	switch tag {
+	case tagPublicKey, tagSecretKey, tagPublicSubkey, tagSecretSubkey:
+		if fp := keyPacketFingerprint(tag, body, pkt); fp != ([20]byte{}) {
+			return keySectionId(fp)
+		}
+	case tagUserId, tagUserAttribute:
+		return fmt.Sprintf("%d:%s", tag, body)
+	}
+	return "key:" + string(pkt)
+}
+
+func keySectionId(fp [20]byte) string {
+	return "key:" + string(fp[:])
+}
+
+// mergeSections adds the sections of another copy of a key to sections.
+// The key packets of the later copy win, signatures are collected from all
+// copies.
+func mergeSections(sections, update []*keySection) []*keySection {
+	for _, u := range update {
+		s := findSection(sections, u.id)
+		if s == nil {
+			s = &keySection{id: u.id, tag: u.tag}
+			sections = append(sections, s)
+		}
+		s.pkt = u.pkt
+		for _, p := range u.packets {
+			if !containsPacket(s.packets, p) {
+				s.packets = append(s.packets, p)
+			}
+		}
+	}
+	return sections
+}
+
+func findSection(sections []*keySection, id string) *keySection {
+	for _, s := range sections {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func containsPacket(packets [][]byte, p []byte) bool {
+	for _, q := range packets {
+		if bytes.Equal(p, q) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneSelfSignatures removes all but the newest self certification of a
+// user id or user attribute section, or all but the newest binding
+// signature of a subkey section. Revocations and signatures made by other
+// keys are kept.
+func pruneSelfSignatures(tag byte, packets [][]byte, keyId uint64) [][]byte {
+	isSelfSig := func(sig *packet.Signature) bool {
+		switch tag {
+		case tagUserId, tagUserAttribute:
+			if sig.SigType < packet.SigTypeGenericCert || sig.SigType > packet.SigTypePositiveCert {
+				return false
+			}
+		case tagPublicSubkey, tagSecretSubkey:
+			if sig.SigType != packet.SigTypeSubkeyBinding {
+				return false
+			}
+		default:
+			return false
+		}
+		return sig.IssuerKeyId != nil && *sig.IssuerKeyId == keyId
+	}
+	newest := -1
+	var newestTime int64
+	self := make([]bool, len(packets))
+	for i, p := range packets {
+		sig, ok := readSignaturePacket(p)
+		if !ok || !isSelfSig(sig) {
+			continue
+		}
+		self[i] = true
+		if t := sig.CreationTime.Unix(); newest < 0 || t >= newestTime {
+			newest, newestTime = i, t
+		}
+	}
+	var result [][]byte
+	for i, p := range packets {
+		if !self[i] || i == newest {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func readSignaturePacket(pkt []byte) (*packet.Signature, bool) {
+	p, err := packet.Read(bytes.NewReader(pkt))
+	if err != nil {
+		return nil, false
+	}
+	sig, ok := p.(*packet.Signature)
+	return sig, ok
+}
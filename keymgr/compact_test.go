@@ -0,0 +1,98 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestCompactKeyrings(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	config := openpgpTestConfig()
+	e, err := generateNewKey("foo", "", "foo@bar.com", nil, config)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	path := nymsPath(publicKeyringFilename)
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, packets := splitSections(original)
+
+	// a duplicate copy followed by a copy with a newer self signature
+	b := bytes.NewBuffer(append([]byte{}, original...))
+	b.Write(original)
+	var id string
+	for name := range e.Identities {
+		id = name
+	}
+	sig, err := newSignatureBuilder(packet.SigTypePositiveCert, crypto.SHA256, time.Unix(100, 0)).
+		signUserId(id, e.PrimaryKey, e.PrivateKey, config.Random())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.PrimaryKey.Serialize(b)
+	e.Identities[id].UserId.Serialize(b)
+	sig.Serialize(b)
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadDefaultKeyring(); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := CompactKeyrings()
+	if err != nil {
+		t.Fatalf("error compacting keyrings: %v", err)
+	}
+	if n != packets+3 {
+		t.Errorf("expecting %d packets removed, got %d", packets+3, n)
+	}
+	nyms, _, _ := loadKeyrings()
+	if len(nyms.public) != 1 {
+		t.Fatalf("expecting 1 key after compaction, got %d", len(nyms.public))
+	}
+	k := nyms.public[0]
+	if !k.Identities[id].SelfSignature.CreationTime.Equal(time.Unix(100, 0)) {
+		t.Error("newest self signature was not kept")
+	}
+	if len(k.Subkeys) != len(e.Subkeys) {
+		t.Errorf("expecting %d subkeys after compaction, got %d", len(e.Subkeys), len(k.Subkeys))
+	}
+	if len(KeySource().GetPublicKeyRing()) != 1 {
+		t.Error("key store was not reloaded after compaction")
+	}
+	if n, err := CompactKeyrings(); n != 0 || err != nil {
+		t.Errorf("compacting again removed %d packets (%v)", n, err)
+	}
+}
+
+func TestCompactKeepsDamagedBlocks(t *testing.T) {
+	damaged := func(b byte) []byte {
+		buf := &bytes.Buffer{}
+		// a secret key packet which cannot be parsed has no fingerprint
+		writePacket(buf, tagSecretKey, []byte{4, 0, 0, 0, b, 1})
+		writePacket(buf, tagUserId, []byte("damaged"))
+		return buf.Bytes()
+	}
+	data := append(damaged(1), damaged(2)...)
+	blocks, err := splitKeyBlocks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 || blocks[0].fingerprint != ([20]byte{}) || blocks[1].fingerprint != ([20]byte{}) {
+		t.Fatalf("expecting 2 blocks without fingerprint, got %d", len(blocks))
+	}
+	compacted, removed := compactKeyBlocks(blocks)
+	if removed != 0 {
+		t.Errorf("expecting no packets removed, got %d", removed)
+	}
+	if !bytes.Equal(compacted, data) {
+		t.Error("damaged blocks were changed by compaction")
+	}
+}
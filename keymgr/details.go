@@ -0,0 +1,178 @@
+package keymgr
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/elgamal"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// Key usages reported in KeyDetails
+const (
+	UsageCertify      = "certify"
+	UsageSign         = "sign"
+	UsageEncrypt      = "encrypt"
+	UsageAuthenticate = "authenticate"
+)
+
+// KeyDetails describes a primary key or subkey. Created and Expires are
+// unix times, Expires is zero if the key does not expire. Bits is zero for
+// keys the openpgp package cannot parse.
+type KeyDetails struct {
+	KeyId        string
+	Fingerprint  string
+	Algorithm    string
+	Bits         int
+	Created      int64
+	Expires      int64
+	Usage        []string
+	Expired      bool
+	Revoked      bool
+	HasSecretKey bool
+}
+
+// UserIdDetails describes a user id of a key. SelfSigned is the unix time
+// of its self signature.
+type UserIdDetails struct {
+	UserId     string
+	Name       string
+	Comment    string
+	Email      string
+	Primary    bool
+	Revoked    bool
+	SelfSigned int64
+}
+
+// DescribeKey returns the details of the primary key of e and of its
+// subkeys. HasSecretKey is looked up in the secret keys of the default key
+// store, so it is also reported for the public copy of a key.
+func DescribeKey(e *openpgp.Entity) (KeyDetails, []KeyDetails) {
+	return defaultKeys.describeKey(e)
+}
+
+func (store *keyStore) describeKey(e *openpgp.Entity) (KeyDetails, []KeyDetails) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	sec := store.secretIndex.lookupFingerprint(e.PrimaryKey.Fingerprint)
+	x := store.extras(e)
+	now := time.Now()
+	primary := newKeyDetails(e.PrimaryKey, KeyExpiration(e), now)
+	primary.Revoked = isKeyRevoked(e)
+	primary.HasSecretKey = sec != nil && sec.PrivateKey != nil
+	if sig := primarySelfSignature(e); sig != nil {
+		primary.Usage = keyUsage(sig, e.PrimaryKey, true)
+	}
+	var subkeys []KeyDetails
+	for _, sk := range e.Subkeys {
+		d := newKeyDetails(sk.PublicKey, subkeyExpiration(sk, x), now)
+		d.Revoked = sk.Sig.SigType == packet.SigTypeSubkeyRevocation
+		if sec != nil {
+			i := findSubkey(sec.Subkeys, sk.PublicKey.Fingerprint)
+			d.HasSecretKey = i >= 0 && sec.Subkeys[i].PrivateKey != nil
+		}
+		binding := sk.Sig
+		if d.Revoked {
+			binding = x.binding(sk.PublicKey.Fingerprint)
+		}
+		if binding != nil {
+			d.Usage = keyUsage(binding, sk.PublicKey, false)
+		}
+		subkeys = append(subkeys, d)
+	}
+	return primary, subkeys
+}
+
+// DescribeUserIds returns the details of the user ids of e, starting with
+// the primary user id.
+func DescribeUserIds(e *openpgp.Entity) []UserIdDetails {
+	var details []UserIdDetails
+	for _, ident := range sortedIdentities(e) {
+		d := UserIdDetails{
+			UserId:  ident.Name,
+			Primary: isPrimaryIdentity(ident),
+			Revoked: isUserIdRevoked(e, ident.Name, ident),
+		}
+		if uid := ident.UserId; uid != nil {
+			d.Name, d.Comment, d.Email = uid.Name, uid.Comment, userIdEmail(uid)
+			if uid.Email == "" && d.Email != "" && d.Name == uid.Id {
+				// a bare address is not a name
+				d.Name = ""
+			}
+		}
+		if ident.SelfSignature != nil {
+			d.SelfSigned = ident.SelfSignature.CreationTime.Unix()
+		}
+		details = append(details, d)
+	}
+	return details
+}
+
+func newKeyDetails(pk *packet.PublicKey, expires, now time.Time) KeyDetails {
+	d := KeyDetails{
+		KeyId:       fmt.Sprintf("%016x", pk.KeyId),
+		Fingerprint: hex.EncodeToString(pk.Fingerprint[:]),
+		Algorithm:   algorithmName(pk.PubKeyAlgo),
+		Bits:        keyBits(pk),
+		Created:     pk.CreationTime.Unix(),
+	}
+	if !expires.IsZero() {
+		d.Expires = expires.Unix()
+		d.Expired = now.After(expires)
+	}
+	return d
+}
+
+// keyUsage returns the usages granted by the key flags of the self
+// signature or binding sig. Without key flags the usages are those the
+// algorithm of pk allows.
+func keyUsage(sig *packet.Signature, pk *packet.PublicKey, primary bool) []string {
+	var flags byte
+	if sig.FlagsValid {
+		flags = signatureKeyFlags(sig)
+	} else {
+		if pk.PubKeyAlgo.CanSign() {
+			flags |= keyFlagSign
+			if primary {
+				flags |= keyFlagCertify
+			}
+		}
+		if pk.PubKeyAlgo.CanEncrypt() {
+			flags |= keyFlagEncryptCommunications
+		}
+	}
+	var usage []string
+	if flags&keyFlagCertify != 0 {
+		usage = append(usage, UsageCertify)
+	}
+	if flags&keyFlagSign != 0 {
+		usage = append(usage, UsageSign)
+	}
+	if flags&(keyFlagEncryptCommunications|keyFlagEncryptStorage) != 0 {
+		usage = append(usage, UsageEncrypt)
+	}
+	if flags&keyFlagAuthenticate != 0 {
+		usage = append(usage, UsageAuthenticate)
+	}
+	return usage
+}
+
+// keyBits returns the size of pk, the curve size for elliptic curve keys.
+func keyBits(pk *packet.PublicKey) int {
+	switch key := pk.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return key.N.BitLen()
+	case *dsa.PublicKey:
+		return key.P.BitLen()
+	case *elgamal.PublicKey:
+		return key.P.BitLen()
+	case *ecdsa.PublicKey:
+		return key.Curve.Params().BitSize
+	}
+	return 0
+}
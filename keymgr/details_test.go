@@ -0,0 +1,71 @@
+package keymgr
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestDescribeKey(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	params := &KeyParams{Algorithm: "ecdsa", Bits: 1024, SigningSubkey: true, Lifetime: time.Hour}
+	e, err := generateNewKey("foo", "work", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+	if _, err := AddUserId(fp, "", "", "foo@example.com", nil); err != nil {
+		t.Fatalf("error adding user id: %v", err)
+	}
+	signing := e.Subkeys[1].PublicKey.KeyId
+	k, err := RevokeSubkey(fp, signing, ReasonRetired, "", nil)
+	if err != nil {
+		t.Fatalf("error revoking subkey: %v", err)
+	}
+	s := storedSecretKey(t)
+
+	primary, subkeys := DescribeKey(k)
+	if primary.Algorithm != "ECDSA" || primary.Bits != 256 || !primary.HasSecretKey || primary.Revoked {
+		t.Errorf("unexpected primary key details %+v", primary)
+	}
+	if primary.Expires != e.PrimaryKey.CreationTime.Add(time.Hour).Unix() || primary.Expired {
+		t.Errorf("unexpected primary key expiration %+v", primary)
+	}
+	if !reflect.DeepEqual(primary.Usage, []string{UsageCertify, UsageSign}) {
+		t.Errorf("primary key usage %v", primary.Usage)
+	}
+	if len(subkeys) != 2 {
+		t.Fatalf("expected 2 subkeys, got %d", len(subkeys))
+	}
+	if enc := subkeys[0]; enc.Algorithm != "RSA" || enc.Bits != 1024 || enc.Revoked ||
+		!reflect.DeepEqual(enc.Usage, []string{UsageEncrypt}) {
+		t.Errorf("unexpected encryption subkey details %+v", enc)
+	}
+	if sig := subkeys[1]; !sig.Revoked || !sig.HasSecretKey || !reflect.DeepEqual(sig.Usage, []string{UsageSign}) {
+		t.Errorf("unexpected signing subkey details %+v", sig)
+	}
+
+	uids := DescribeUserIds(s)
+	if len(uids) != 2 {
+		t.Fatalf("expected 2 user ids, got %d", len(uids))
+	}
+	if u := uids[0]; u.Name != "foo" || u.Comment != "work" || u.Email != "foo@bar.com" || !u.Primary || u.SelfSigned == 0 {
+		t.Errorf("unexpected primary user id details %+v", u)
+	}
+	if u := uids[1]; u.Email != "foo@example.com" || u.Primary || u.Revoked {
+		t.Errorf("unexpected user id details %+v", u)
+	}
+}
+
+func TestDescribeUnsplitUserId(t *testing.T) {
+	e := syntheticKeyring(1)[0]
+	uid := &packet.UserId{Id: "bare@example.com", Name: "bare@example.com"}
+	e.Identities = map[string]*openpgp.Identity{uid.Id: {Name: uid.Id, UserId: uid}}
+	uids := DescribeUserIds(e)
+	if len(uids) != 1 || uids[0].Name != "" || uids[0].Email != "bare@example.com" {
+		t.Errorf("unexpected user id details %+v", uids)
+	}
+}
@@ -0,0 +1,229 @@
+package keymgr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"code.google.com/p/go.crypto/openpgp"
+	pgperrors "code.google.com/p/go.crypto/openpgp/errors"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// KeyDiagnostic describes key data which was skipped while loading a
+// keyring, either a whole key or a part of a key such as a subkey.
+type KeyDiagnostic struct {
+	// Path is the keyring file or gpg-agent key file.
+	Path string
+	// Offset is the position of the skipped data in the file.
+	Offset int
+	// Fingerprint is the hex encoded fingerprint of the key the data
+	// belongs to, or empty if it is not known.
+	Fingerprint string
+	Reason      string
+}
+
+func (d KeyDiagnostic) String() string {
+	key := d.Fingerprint
+	if key == "" {
+		key = "unknown key"
+	}
+	return fmt.Sprintf("%s at offset %d (%s): %s", d.Path, d.Offset, key, d.Reason)
+}
+
+// Diagnostics returns the problems found while the keyrings of the default
+// key store were last loaded.
+func Diagnostics() []KeyDiagnostic {
+	return defaultKeys.getDiagnostics()
+}
+
+func (store *keyStore) getDiagnostics() []KeyDiagnostic {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	ds := make([]KeyDiagnostic, 0, len(store.nyms.diagnostics)+len(store.gnupg.diagnostics))
+	ds = append(ds, store.nyms.diagnostics...)
+	return append(ds, store.gnupg.diagnostics...)
+}
+
+// loadReport collects the diagnostics and the extras of the entities for
+// one keyring while it is loaded. Skipped data is logged even if the
+// report is nil.
+type loadReport struct {
+	diagnostics []KeyDiagnostic
+	extras      map[*openpgp.Entity]*keyExtras
+}
+
+// addExtras records x as the extras of e.
+func (r *loadReport) addExtras(e *openpgp.Entity, x *keyExtras) {
+	if r == nil {
+		return
+	}
+	if r.extras == nil {
+		r.extras = make(map[*openpgp.Entity]*keyExtras)
+	}
+	r.extras[e] = x
+}
+
+func (r *loadReport) skip(path string, offset int, fp [20]byte, reason error) {
+	d := KeyDiagnostic{Path: path, Offset: offset, Reason: reason.Error()}
+	if fp != ([20]byte{}) {
+		d.Fingerprint = hex.EncodeToString(fp[:])
+	}
+	logger.Warningf("Skipping key data in %v", d)
+	if r != nil {
+		r.diagnostics = append(r.diagnostics, d)
+	}
+}
+
+// readKeyringData parses a binary keyring read from path one key at a
+// time. Keys which cannot be parsed are skipped and reported to r, offsets
+// are reported relative to base. The extras of the keys are added to r.
+func readKeyringData(path string, base int, data []byte, r *loadReport) openpgp.EntityList {
+	el := openpgp.EntityList{}
+	blocks, err := splitKeyBlocks(data)
+	for _, b := range blocks {
+		e, dropped, unparsed, perr := readKeyBlock(b.data)
+		for _, d := range dropped {
+			r.skip(path, base+b.offset+d.offset, b.fingerprint, d.err)
+		}
+		if perr != nil {
+			r.skip(path, base+b.offset, b.fingerprint, describeKeyError(b.data, perr))
+			continue
+		}
+		if x := readKeyExtras(e, b.data, unparsed); x != nil {
+			r.addExtras(e, x)
+		}
+		el = append(el, e)
+	}
+	if err != nil {
+		end := 0
+		if len(blocks) > 0 {
+			last := blocks[len(blocks)-1]
+			end = last.offset + len(last.data)
+		}
+		r.skip(path, base+end, [20]byte{}, err)
+	}
+	return el
+}
+
+// droppedPacket is a packet left out of a key because it cannot be parsed.
+type droppedPacket struct {
+	offset int
+	err    error
+}
+
+// readKeyBlock parses the packets of a single key. If the key contains
+// packets which cannot be parsed, for example a subkey using an unsupported
+// algorithm, it is read again without them and the dropped packets are
+// returned, both for reporting and as sections to be kept with the key.
+func readKeyBlock(data []byte) (*openpgp.Entity, []droppedPacket, []*keySection, error) {
+	e, err := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(data)))
+	if err == nil {
+		return e, nil, nil, nil
+	}
+	clean, dropped, unparsed := dropUnparseablePackets(data)
+	if len(dropped) == 0 {
+		return nil, nil, nil, err
+	}
+	e, cerr := openpgp.ReadEntity(packet.NewReader(bytes.NewReader(clean)))
+	if cerr != nil {
+		return nil, nil, nil, err
+	}
+	return e, dropped, unparsed, nil
+}
+
+// dropUnparseablePackets removes the packets following the primary key
+// which cannot be parsed. The signatures following a dropped user id or
+// subkey are dropped with it. The dropped packets are also returned as
+// sections: a dropped user id or subkey is returned with its signatures,
+// and dropped signatures of a kept packet in a section with the id of
+// that packet but without the packet itself.
+func dropUnparseablePackets(data []byte) ([]byte, []droppedPacket, []*keySection) {
+	clean := &bytes.Buffer{}
+	var dropped []droppedPacket
+	var unparsed []*keySection
+	var owner, drop *keySection
+	for off := 0; off < len(data); {
+		tag, body, n, err := nextPacket(data[off:])
+		if err != nil {
+			break
+		}
+		pkt := data[off : off+n]
+		switch {
+		case tag == tagSignature && drop != nil:
+			drop.packets = append(drop.packets, pkt)
+		case off == 0:
+			clean.Write(pkt)
+			owner = &keySection{id: sectionId(tag, body, pkt), tag: tag}
+		default:
+			if _, err := packet.Read(bytes.NewReader(pkt)); err != nil && !isUnknownPacket(err) {
+				dropped = append(dropped, droppedPacket{off, fmt.Errorf("%s skipped: %v", packetName(tag, body), err)})
+				if tag != tagSignature {
+					drop = &keySection{id: sectionId(tag, body, pkt), tag: tag, pkt: pkt}
+					unparsed = append(unparsed, drop)
+				} else {
+					if len(owner.packets) == 0 {
+						unparsed = append(unparsed, owner)
+					}
+					owner.packets = append(owner.packets, pkt)
+				}
+			} else {
+				clean.Write(pkt)
+				if tag != tagSignature {
+					drop = nil
+				}
+				switch tag {
+				case tagPublicSubkey, tagSecretSubkey, tagUserId, tagUserAttribute:
+					owner = &keySection{id: sectionId(tag, body, pkt), tag: tag}
+				}
+			}
+		}
+		off += n
+	}
+	return clean.Bytes(), dropped, unparsed
+}
+
+func isUnknownPacket(err error) bool {
+	_, ok := err.(pgperrors.UnknownPacketTypeError)
+	return ok
+}
+
+// describeKeyError names the algorithm of a key which could not be read
+// because the openpgp package does not support it.
+func describeKeyError(data []byte, err error) error {
+	if _, ok := err.(pgperrors.UnsupportedError); !ok {
+		return err
+	}
+	if _, body, _, perr := nextPacket(data); perr == nil {
+		if algo, ok := keyPacketAlgorithm(body); ok {
+			return fmt.Errorf("unsupported %s key: %v", algorithmName(algo), err)
+		}
+	}
+	return err
+}
+
+// keyPacketAlgorithm returns the public key algorithm of a version 4 key
+// packet body.
+func keyPacketAlgorithm(body []byte) (packet.PublicKeyAlgorithm, bool) {
+	if len(body) < 6 || body[0] != 4 {
+		return 0, false
+	}
+	return packet.PublicKeyAlgorithm(body[5]), true
+}
+
+func packetName(tag byte, body []byte) string {
+	switch tag {
+	case tagSignature:
+		return "signature"
+	case tagPublicSubkey, tagSecretSubkey:
+		if algo, ok := keyPacketAlgorithm(body); ok {
+			return algorithmName(algo) + " subkey"
+		}
+		return "subkey"
+	case tagUserId:
+		return "user id"
+	case tagUserAttribute:
+		return "user attribute"
+	}
+	return fmt.Sprintf("packet (tag %d)", tag)
+}
@@ -0,0 +1,138 @@
+package keymgr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// ed25519PublicKeyPacket returns an EdDSA public key packet, an algorithm
+// the openpgp package cannot parse.
+func ed25519PublicKeyPacket(tag byte) []byte {
+	body := []byte{4, 0x54, 0, 0, 0, 22}
+	body = append(body, 9, 0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01)
+	body = append(body, 0x01, 0x07, 0x40)
+	body = append(body, make([]byte, 32)...)
+	b := &bytes.Buffer{}
+	writePacket(b, tag, body)
+	return b.Bytes()
+}
+
+// ed25519SignaturePacket returns an EdDSA signature packet, which the
+// openpgp package cannot parse.
+func ed25519SignaturePacket(sigType packet.SignatureType) []byte {
+	body := []byte{4, byte(sigType), 22, 8, 0, 0, 0, 0, 0, 0}
+	body = append(body, 0, 8, 1, 0, 8, 1)
+	b := &bytes.Buffer{}
+	writePacket(b, tagSignature, body)
+	return b.Bytes()
+}
+
+func serializedTestKey(t *testing.T, name string) []byte {
+	b := &bytes.Buffer{}
+	if err := toEntity(testDataMap[name].pubkey).Serialize(b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSkipUnsupportedKey(t *testing.T) {
+	data := serializedTestKey(t, "user1")
+	unsupported := ed25519PublicKeyPacket(tagPublicKey)
+	offset := len(data)
+	data = append(data, unsupported...)
+	data = append(data, serializedTestKey(t, "user2")...)
+
+	r := &loadReport{}
+	el := readKeyringData("pubring.gpg", 0, data, r)
+	if len(el) != 2 {
+		t.Fatalf("expecting 2 keys, got %d", len(el))
+	}
+	if len(r.diagnostics) != 1 {
+		t.Fatalf("expecting 1 diagnostic, got %v", r.diagnostics)
+	}
+	d := r.diagnostics[0]
+	_, body, _, _ := nextPacket(unsupported)
+	fp := keyPacketFingerprint(tagPublicKey, body, unsupported)
+	if d.Path != "pubring.gpg" || d.Offset != offset || d.Fingerprint != hex.EncodeToString(fp[:]) {
+		t.Errorf("unexpected diagnostic %v", d)
+	}
+}
+
+func TestSkipUnsupportedSubkey(t *testing.T) {
+	data := serializedTestKey(t, "user1")
+	offset := len(data)
+	data = append(data, ed25519PublicKeyPacket(tagPublicSubkey)...)
+
+	r := &loadReport{}
+	el := readKeyringData("pubring.gpg", 0, data, r)
+	if len(el) != 1 {
+		t.Fatalf("key with unsupported subkey was not kept")
+	}
+	if len(el[0].Subkeys) != 1 {
+		t.Errorf("expecting 1 subkey, got %d", len(el[0].Subkeys))
+	}
+	if len(r.diagnostics) != 1 || r.diagnostics[0].Offset != offset {
+		t.Errorf("unexpected diagnostics %v", r.diagnostics)
+	}
+}
+
+func TestUnparseablePacketsAreKept(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	sections, _ := splitSections(serializedTestKey(t, "user1"))
+	data := &bytes.Buffer{}
+	var uid string
+	for _, s := range sections {
+		data.Write(s.pkt)
+		for _, p := range s.packets {
+			data.Write(p)
+		}
+		if s.tag == tagUserId && uid == "" {
+			uid = s.id
+			data.Write(ed25519SignaturePacket(packet.SigTypeGenericCert))
+		}
+	}
+	subkey := ed25519PublicKeyPacket(tagPublicSubkey)
+	data.Write(subkey)
+	data.Write(ed25519SignaturePacket(packet.SigTypeSubkeyBinding))
+	expectImport(t, data.Bytes(), ImportNew)
+
+	// merging a new user id rewrites the stored key
+	updated := withUserId(t, toEntity(testDataMap["user1"].seckey), "Other User 1", "other1@example.com")
+	expectImport(t, armoredPublicKey(t, updated), ImportUpdated)
+
+	nyms, _, err := loadKeyrings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nyms.public) != 1 || len(nyms.public[0].Identities) != 2 {
+		t.Fatal("rewritten key not found")
+	}
+	x := nyms.extras[nyms.public[0]]
+	if len(x.unparsedSignatures(uid)) != 1 {
+		t.Error("unparseable certification of the user id was lost")
+	}
+	if sections := x.unparsedSections(false, false); len(sections) != 1 || !bytes.Equal(sections[0].pkt, subkey) || len(sections[0].packets) != 1 {
+		t.Error("unparseable subkey was lost")
+	}
+	if len(nyms.diagnostics) != 2 {
+		t.Errorf("expecting 2 diagnostics for the rewritten key, got %v", nyms.diagnostics)
+	}
+}
+
+func TestSkipDamagedData(t *testing.T) {
+	data := serializedTestKey(t, "user1")
+	offset := len(data)
+	data = append(data, 0xc6, 0xff, 0, 0, 0x10)
+
+	r := &loadReport{}
+	el := readKeyringData("pubring.gpg", 100, data, r)
+	if len(el) != 1 {
+		t.Fatalf("expecting 1 key, got %d", len(el))
+	}
+	if len(r.diagnostics) != 1 || r.diagnostics[0].Offset != 100+offset {
+		t.Errorf("unexpected diagnostics %v", r.diagnostics)
+	}
+}
@@ -0,0 +1,195 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"io"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+var errExpirationInPast = errors.New("expiration time is in the past")
+var errNoExpirationTarget = errors.New("no key given to set the expiration of")
+var errSubkeyRevoked = errors.New("subkey is revoked")
+var errNoValidUserId = errors.New("all user ids of the key are revoked")
+
+// KeyExpiration returns the time at which the primary key of e expires
+// according to the self signature of its primary user id, or the zero
+// time if it does not expire. Revoked user ids are not considered.
+func KeyExpiration(e *openpgp.Entity) time.Time {
+	return expirationTime(e.PrimaryKey, primarySelfSignature(e))
+}
+
+// SubkeyExpiration returns the time at which the subkey sk of e expires,
+// or the zero time if it does not expire. For a revoked subkey the binding
+// signature kept with e in the default key store is used.
+func SubkeyExpiration(e *openpgp.Entity, sk openpgp.Subkey) time.Time {
+	return subkeyExpiration(sk, defaultKeys.lookupExtras(e))
+}
+
+// subkeyExpiration is like SubkeyExpiration with the extras x of the key.
+func subkeyExpiration(sk openpgp.Subkey, x *keyExtras) time.Time {
+	sig := sk.Sig
+	if sig.SigType == packet.SigTypeSubkeyRevocation {
+		sig = x.binding(sk.PublicKey.Fingerprint)
+	}
+	return expirationTime(sk.PublicKey, sig)
+}
+
+// expirationTime returns the expiration of pk given by its self signature
+// sig. Key lifetimes are counted from the creation of the key.
+func expirationTime(pk *packet.PublicKey, sig *packet.Signature) time.Time {
+	lifetime := signatureLifetime(sig)
+	if lifetime == 0 {
+		return time.Time{}
+	}
+	return pk.CreationTime.Add(lifetime)
+}
+
+// SetExpiration sets the expiration of the key with the given fingerprint,
+// which must be in the nyms secret keyring, by signing its user ids or
+// subkeys again. The expiration of the primary key is set if primary is
+// set, and that of the subkeys with the given ids, all in one change of
+// the key. A zero expires removes the expiration. If the secret key is
+// locked it is unlocked with passphrase. The changed secret key is
+// returned.
+func SetExpiration(fingerprint [20]byte, expires time.Time, primary bool, subkeyIds []uint64, passphrase []byte) (*openpgp.Entity, error) {
+	if !primary && len(subkeyIds) == 0 {
+		return nil, errNoExpirationTarget
+	}
+	now := time.Now()
+	if !expires.IsZero() && !expires.After(now) {
+		return nil, errExpirationInPast
+	}
+	return changeKey(fingerprint, passphrase, func(e *openpgp.Entity, x *keyExtras, signer *packet.PrivateKey) (func(*openpgp.Entity, *keyExtras), error) {
+		var changes []func(*openpgp.Entity, *keyExtras)
+		if primary {
+			lifetime := keyLifetime(e.PrimaryKey, expires)
+			if err := checkLifetime(lifetime); err != nil {
+				return nil, err
+			}
+			apply, err := expireUserIds(e, signer, lifetime, now)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, apply)
+		}
+		if len(subkeyIds) > 0 {
+			apply, err := expireSubkeys(e, signer, subkeyIds, expires, now)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, apply)
+		}
+		return func(c *openpgp.Entity, cx *keyExtras) {
+			for _, apply := range changes {
+				apply(c, cx)
+			}
+		}, nil
+	})
+}
+
+// expireUserIds signs the user ids of e which are not revoked again with
+// the given key lifetime. Only the primary identity among them is marked
+// as primary.
+func expireUserIds(e *openpgp.Entity, signer *packet.PrivateKey, lifetime time.Duration, now time.Time) (func(*openpgp.Entity, *keyExtras), error) {
+	primary := primaryIdentity(e)
+	if primary == nil {
+		return nil, errNoValidUserId
+	}
+	sigs := make(map[string]*packet.Signature)
+	for name, ident := range e.Identities {
+		if isUserIdRevoked(e, name, ident) {
+			continue
+		}
+		b := newSelfSignatureBuilder(ident.SelfSignature, now, ident == primary, lifetime)
+		sig, err := b.signUserId(name, e.PrimaryKey, signer, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		sigs[name] = sig
+	}
+	return func(c *openpgp.Entity, _ *keyExtras) {
+		for name, sig := range sigs {
+			if ident, ok := c.Identities[name]; ok {
+				ident.SelfSignature = sig
+			}
+		}
+	}, nil
+}
+
+func expireSubkeys(e *openpgp.Entity, signer *packet.PrivateKey, subkeyIds []uint64, expires, now time.Time) (func(*openpgp.Entity, *keyExtras), error) {
+	h := signatureHash(selfSignatureTemplate(e))
+	var changed []openpgp.Subkey
+	for _, id := range subkeyIds {
+		i := findSubkeyById(e, id)
+		if i < 0 {
+			return nil, errSubkeyNotFound
+		}
+		sk := e.Subkeys[i]
+		if sk.Sig.SigType == packet.SigTypeSubkeyRevocation {
+			return nil, errSubkeyRevoked
+		}
+		lifetime := keyLifetime(sk.PublicKey, expires)
+		if err := checkLifetime(lifetime); err != nil {
+			return nil, err
+		}
+		created := now
+		if !created.After(sk.Sig.CreationTime) {
+			created = sk.Sig.CreationTime.Add(time.Second)
+		}
+		sig, err := rebindSubkey(e.PrimaryKey, sk, signer, h, created, lifetime, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		sk.Sig = sig
+		changed = append(changed, sk)
+	}
+	return func(c *openpgp.Entity, _ *keyExtras) {
+		for _, sk := range changed {
+			if i := findSubkey(c.Subkeys, sk.PublicKey.Fingerprint); i >= 0 {
+				c.Subkeys[i].Sig = sk.Sig
+			}
+		}
+	}, nil
+}
+
+// keyLifetime returns the lifetime which lets pk expire at expires, zero
+// for a zero expires.
+func keyLifetime(pk *packet.PublicKey, expires time.Time) time.Duration {
+	if expires.IsZero() {
+		return 0
+	}
+	lifetime := expires.Sub(pk.CreationTime)
+	if lifetime < time.Second {
+		lifetime = time.Second
+	}
+	return lifetime
+}
+
+// rebindSubkey signs a new binding for sk with the key flags of its
+// current binding and the given lifetime. The back signature of a signing
+// subkey is carried over, since it does not depend on the binding.
+func rebindSubkey(pub *packet.PublicKey, sk openpgp.Subkey, signer *packet.PrivateKey, h crypto.Hash, created time.Time, lifetime time.Duration, rand io.Reader) (*packet.Signature, error) {
+	b := newSignatureBuilder(packet.SigTypeSubkeyBinding, h, created)
+	if sk.Sig.FlagsValid {
+		b.add(subpacketKeyFlags, signatureKeyFlags(sk.Sig))
+	}
+	b.addLifetime(subpacketKeyExpiration, lifetime)
+	if back := sk.Sig.EmbeddedSignature; back != nil {
+		buf := &bytes.Buffer{}
+		if err := back.Serialize(buf); err != nil {
+			return nil, err
+		}
+		_, body, _, err := nextPacket(buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		b.add(subpacketEmbeddedSignature, body...)
+	}
+	return b.signKey(pub, sk.PublicKey, signer, rand)
+}
@@ -0,0 +1,109 @@
+package keymgr
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSetExpiration(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	year := 24 * 365 * time.Hour
+	params := &KeyParams{Algorithm: "ecdsa", SigningSubkey: true, Lifetime: year, Passphrase: []byte("password")}
+	e, err := generateNewKey("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+	if !KeyExpiration(e).Equal(e.PrimaryKey.CreationTime.Add(year)) {
+		t.Errorf("unexpected expiration %v of generated key", KeyExpiration(e))
+	}
+
+	if _, err := SetExpiration(fp, time.Now().Add(-time.Hour), true, nil, []byte("password")); err != errExpirationInPast {
+		t.Errorf("setting expiration in the past returned %v", err)
+	}
+	tooLong := time.Duration(math.MaxUint32+1) * time.Second
+	if _, err := SetExpiration(fp, e.PrimaryKey.CreationTime.Add(tooLong), true, nil, []byte("password")); err != errLifetimeTooLong {
+		t.Errorf("setting expiration beyond the maximum lifetime returned %v", err)
+	}
+	if _, err := AddSubkey(fp, SubkeyEncrypt, &KeyParams{Lifetime: tooLong}, []byte("password")); err != errLifetimeTooLong {
+		t.Errorf("adding subkey with a lifetime beyond the maximum returned %v", err)
+	}
+	if _, err := newEntity("foo", "", "foo@bar.com", &KeyParams{Lifetime: tooLong}, nil); err != errLifetimeTooLong {
+		t.Errorf("generating key with a lifetime beyond the maximum returned %v", err)
+	}
+	expires := time.Unix(time.Now().Add(2*year).Unix(), 0)
+	k, err := SetExpiration(fp, expires, true, nil, []byte("password"))
+	if err != nil {
+		t.Fatalf("error setting expiration: %v", err)
+	}
+	if !KeyExpiration(k).Equal(expires) {
+		t.Errorf("expiration is %v, expecting %v", KeyExpiration(k), expires)
+	}
+	if k, err = SetExpiration(fp, time.Time{}, true, nil, []byte("password")); err != nil || !KeyExpiration(k).IsZero() {
+		t.Errorf("expiration not removed: %v", err)
+	}
+
+	signing := e.Subkeys[1].PublicKey.KeyId
+	if _, err := SetExpiration(fp, expires, false, []uint64{signing}, []byte("password")); err != nil {
+		t.Fatalf("error setting subkey expiration: %v", err)
+	}
+	s := storedSecretKey(t)
+	if !KeyExpiration(s).IsZero() {
+		t.Error("setting subkey expiration changed primary key expiration")
+	}
+	if !SubkeyExpiration(s, s.Subkeys[1]).Equal(expires) {
+		t.Errorf("subkey expiration is %v, expecting %v", SubkeyExpiration(s, s.Subkeys[1]), expires)
+	}
+	if !SubkeyExpiration(s, s.Subkeys[0]).Equal(e.Subkeys[0].PublicKey.CreationTime.Add(year)) {
+		t.Error("expiration of other subkey changed")
+	}
+	if s.Subkeys[1].Sig.EmbeddedSignature == nil {
+		t.Error("back signature of signing subkey dropped")
+	}
+
+	if _, err := SetExpiration(fp, expires, false, nil, []byte("password")); err != errNoExpirationTarget {
+		t.Errorf("setting expiration without a target returned %v", err)
+	}
+	later := expires.Add(year)
+	all := []uint64{e.Subkeys[0].PublicKey.KeyId, signing}
+	if k, err = SetExpiration(fp, later, true, all, []byte("password")); err != nil {
+		t.Fatalf("error setting expiration of the whole key: %v", err)
+	}
+	if !KeyExpiration(k).Equal(later) {
+		t.Errorf("primary key expiration is %v, expecting %v", KeyExpiration(k), later)
+	}
+	for _, sk := range k.Subkeys {
+		if !SubkeyExpiration(k, sk).Equal(later) {
+			t.Errorf("subkey expiration is %v, expecting %v", SubkeyExpiration(k, sk), later)
+		}
+	}
+}
+
+func TestExpirationIgnoresRevokedUserIds(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	year := 24 * 365 * time.Hour
+	params := &KeyParams{Algorithm: "ecdsa", Lifetime: year}
+	e, err := generateNewKey("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+	if _, err := AddUserId(fp, "foo", "", "foo@baz.com", nil); err != nil {
+		t.Fatalf("error adding user id: %v", err)
+	}
+	if _, err := RevokeUserId(fp, "foo <foo@bar.com>", ReasonUserIdInvalid, "", nil); err != nil {
+		t.Fatalf("error revoking user id: %v", err)
+	}
+	expires := time.Unix(time.Now().Add(2*year).Unix(), 0)
+	k, err := SetExpiration(fp, expires, true, nil, nil)
+	if err != nil {
+		t.Fatalf("error setting expiration: %v", err)
+	}
+	if !KeyExpiration(k).After(e.PrimaryKey.CreationTime.Add(year)) {
+		t.Errorf("expiration is %v, expecting %v", KeyExpiration(k), expires)
+	}
+	if ident := k.Identities["foo <foo@baz.com>"]; !isPrimaryIdentity(ident) {
+		t.Error("remaining user id was not marked as primary")
+	}
+}
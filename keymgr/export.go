@@ -0,0 +1,176 @@
+package keymgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/armor"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// ExportOptions select the form of exported keys. Clean drops user ids
+// which are revoked or expired, certifications by keys which are not in
+// the keyrings and the packets which cannot be parsed. Minimal implies Clean and drops all certifications
+// except the latest self signatures.
+type ExportOptions struct {
+	Secret  bool
+	Armor   bool
+	Clean   bool
+	Minimal bool
+}
+
+var errNoKeysSelected = errors.New("no keys selected for export")
+
+// ExportKeys serializes the keys selected by ids, which are key ids,
+// fingerprints or email addresses. At least one key must be selected.
+func ExportKeys(ids []string, opts ExportOptions) ([]byte, error) {
+	return defaultKeys.exportKeys(ids, opts)
+}
+
+func (store *keyStore) exportKeys(ids []string, opts ExportOptions) ([]byte, error) {
+	if len(ids) == 0 {
+		return nil, errNoKeysSelected
+	}
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	keys, err := store.selectKeys(ids, opts.Secret)
+	if err != nil {
+		return nil, err
+	}
+	b := &bytes.Buffer{}
+	var w io.Writer = b
+	if opts.Armor {
+		header := publicKeyArmorHeader
+		if opts.Secret {
+			header = secretKeyArmorHeader
+		}
+		aw, err := armor.Encode(b, header, map[string]string{})
+		if err != nil {
+			return nil, err
+		}
+		w = aw
+	}
+	for _, e := range keys {
+		x := store.extras(e)
+		if opts.Clean || opts.Minimal {
+			e = store.cleanEntity(e, opts.Minimal, time.Now())
+			x = x.clone()
+			x.unparsed = nil
+		}
+		if err := serializeEntity(w, e, x, opts.Secret); err != nil {
+			return nil, err
+		}
+	}
+	if c, ok := w.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// selectKeys returns the keys matching ids in order without duplicates.
+// It fails if any id does not match a key.
+func (store *keyStore) selectKeys(ids []string, secret bool) (openpgp.EntityList, error) {
+	idx := store.publicIndex
+	if secret {
+		idx = store.secretIndex
+	}
+	var keys openpgp.EntityList
+	seen := make(map[[20]byte]bool)
+	for _, id := range ids {
+		found := findKeys(idx, id)
+		if len(found) == 0 {
+			return nil, fmt.Errorf("no key found for %q", id)
+		}
+		for _, e := range found {
+			if !seen[e.PrimaryKey.Fingerprint] {
+				seen[e.PrimaryKey.Fingerprint] = true
+				keys = append(keys, e)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// findKeys looks up a key by fingerprint or key id in hex, with an
+// optional 0x prefix, or the keys of an email address.
+func findKeys(idx *keyIndex, id string) openpgp.EntityList {
+	id = strings.TrimSpace(id)
+	if strings.Contains(id, "@") {
+		return idx.lookupEmail(id)
+	}
+	id = strings.TrimPrefix(strings.TrimPrefix(id, "0x"), "0X")
+	b, err := hex.DecodeString(strings.Replace(id, " ", "", -1))
+	if err != nil {
+		return nil
+	}
+	switch len(b) {
+	case 20:
+		var fp [20]byte
+		copy(fp[:], b)
+		if e := idx.lookupFingerprint(fp); e != nil {
+			return openpgp.EntityList{e}
+		}
+	case 8:
+		return idx.lookupKeyId(binary.BigEndian.Uint64(b))
+	}
+	return nil
+}
+
+// cleanEntity returns a copy of e without the user ids and certifications
+// dropped by the Clean or Minimal export options. User ids are only
+// dropped if at least one usable user id remains. The read lock must be
+// held.
+func (store *keyStore) cleanEntity(e *openpgp.Entity, minimal bool, now time.Time) *openpgp.Entity {
+	c := copyEntity(e)
+	var unusable []string
+	for name, ident := range c.Identities {
+		var sigs []*packet.Signature
+		revoked := false
+		for _, sig := range ident.Signatures {
+			if isUserIdRevocation(e, name, sig) {
+				revoked = true
+				sigs = append(sigs, sig)
+			} else if !minimal && store.knownIssuer(sig) {
+				sigs = append(sigs, sig)
+			}
+		}
+		ident.Signatures = sigs
+		if revoked || signatureExpired(ident.SelfSignature, now) {
+			unusable = append(unusable, name)
+		}
+	}
+	if len(unusable) < len(c.Identities) {
+		for _, name := range unusable {
+			delete(c.Identities, name)
+		}
+	}
+	return c
+}
+
+func (store *keyStore) knownIssuer(sig *packet.Signature) bool {
+	return sig.IssuerKeyId != nil && len(store.publicIndex.lookupKeyId(*sig.IssuerKeyId)) > 0
+}
+
+// isUserIdRevocation reports whether sig is a valid revocation of the
+// user id name by the key e itself.
+func isUserIdRevocation(e *openpgp.Entity, name string, sig *packet.Signature) bool {
+	return sig.SigType == sigTypeCertificationRevocation &&
+		sig.IssuerKeyId != nil && *sig.IssuerKeyId == e.PrimaryKey.KeyId &&
+		e.PrimaryKey.VerifyUserIdSignature(name, e.PrimaryKey, sig) == nil
+}
+
+func signatureExpired(sig *packet.Signature, now time.Time) bool {
+	if sig.SigLifetimeSecs == nil || *sig.SigLifetimeSecs == 0 {
+		return false
+	}
+	return now.After(sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second))
+}
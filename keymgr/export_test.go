@@ -0,0 +1,109 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// certify returns a signature of type sigType by signer on the user id
+// name of e.
+func certify(t *testing.T, e *openpgp.Entity, name string, signer *openpgp.Entity, sigType packet.SignatureType) *packet.Signature {
+	b := newSignatureBuilder(sigType, crypto.SHA256, time.Now())
+	sig, err := b.signUserId(name, e.PrimaryKey, signer.PrivateKey, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func exportedEntity(t *testing.T, ids []string, opts ExportOptions) *openpgp.Entity {
+	data, err := ExportKeys(ids, opts)
+	if err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	el, err := openpgp.ReadKeyRing(bytes.NewReader(data))
+	if err != nil || len(el) != 1 {
+		t.Fatalf("expecting a single exported key: %v", err)
+	}
+	return el[0]
+}
+
+func TestExportKeys(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	user1 := toEntity(testDataMap["user1"].seckey)
+	params := &KeyParams{Algorithm: "ecdsa", Bits: 1024}
+	known, err := newEntity("known", "", "known@example.com", params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := newEntity("unknown", "", "unknown@example.com", params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddPublicKey(known); err != nil {
+		t.Fatal(err)
+	}
+
+	e := withUserId(t, user1, "Revoked User 1", "revoked1@example.com")
+	revoked := packet.NewUserId("Revoked User 1", "", "revoked1@example.com").Id
+	e.Identities[revoked].Signatures = []*packet.Signature{certify(t, e, revoked, user1, sigTypeCertificationRevocation)}
+	var name string
+	for n := range user1.Identities {
+		name = n
+	}
+	ident := e.Identities[name]
+	ident.Signatures = append(ident.Signatures,
+		certify(t, e, name, known, packet.SigTypeGenericCert),
+		certify(t, e, name, unknown, packet.SigTypeGenericCert))
+	if err := AddPublicKey(e); err != nil {
+		t.Fatal(err)
+	}
+
+	fp := hex.EncodeToString(e.PrimaryKey.Fingerprint[:])
+	keyId := fmt.Sprintf("0x%016X", e.PrimaryKey.KeyId)
+	for _, tc := range []struct {
+		opts  ExportOptions
+		uids  int
+		certs int
+	}{
+		{ExportOptions{}, 2, 2},
+		{ExportOptions{Clean: true}, 1, 1},
+		{ExportOptions{Minimal: true}, 1, 0},
+	} {
+		for _, id := range []string{"user1@example.com", fp, keyId} {
+			k := exportedEntity(t, []string{id}, tc.opts)
+			if len(k.Identities) != tc.uids {
+				t.Errorf("%+v: expecting %d user ids, got %d", tc.opts, tc.uids, len(k.Identities))
+			}
+			if n := len(k.Identities[name].Signatures); n != tc.certs {
+				t.Errorf("%+v: expecting %d certifications, got %d", tc.opts, tc.certs, n)
+			}
+		}
+	}
+
+	data, err := ExportKeys([]string{"user1@example.com", "known@example.com"}, ExportOptions{Armor: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		t.Error("export is not armored")
+	}
+	if el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data)); err != nil || len(el) != 2 {
+		t.Errorf("expecting 2 keys in armored export: %v", err)
+	}
+	if _, err := ExportKeys([]string{"nobody@example.com"}, ExportOptions{}); err == nil {
+		t.Error("no error exporting unknown key")
+	}
+	if _, err := ExportKeys(nil, ExportOptions{}); err != errNoKeysSelected {
+		t.Errorf("exporting no keys: expecting %v, got %v", errNoKeysSelected, err)
+	}
+}
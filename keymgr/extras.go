@@ -0,0 +1,236 @@
+package keymgr
+
+import (
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// keyExtras holds the state of a stored key which openpgp.Entity cannot
+// represent. It is kept in the keyring along with the entity and dropped
+// when the entity is replaced or removed. Stored extras are not changed,
+// a changed key is stored with a changed copy.
+type keyExtras struct {
+	// protected holds the serialized packets of passphrase protected
+	// secret keys by fingerprint. packet.PrivateKey cannot write
+	// encrypted keys, so these packets are written in place of the key
+	// material, also after a key has been unlocked.
+	protected map[[20]byte][]byte
+	// bindings holds the binding signatures of revoked subkeys by subkey
+	// fingerprint. openpgp.Subkey only keeps the revocation of a revoked
+	// subkey, so the binding is kept here to be written along with it.
+	bindings map[[20]byte]*packet.Signature
+	// attributes holds the user attribute sections of the key.
+	// openpgp.Entity drops user attributes, so they are kept here to be
+	// written back along with the key.
+	attributes []*keySection
+	// agentKeys holds the gpg-agent keys of locked secret keys by
+	// fingerprint, which are unlocked with the gpg-agent protection
+	// scheme rather than the OpenPGP one.
+	agentKeys map[[20]byte]*agentKey
+	// unparsed holds the packets of the key which openpgp.Entity does
+	// not represent because the openpgp package cannot parse them, as
+	// returned by dropUnparseablePackets. They are written back along
+	// with the key so that rewriting it does not lose them.
+	unparsed []*keySection
+}
+
+// clone returns a copy of x which can be changed without affecting x.
+// The copy of nil extras is empty.
+func (x *keyExtras) clone() *keyExtras {
+	c := &keyExtras{}
+	if x == nil {
+		return c
+	}
+	if x.protected != nil {
+		c.protected = make(map[[20]byte][]byte, len(x.protected))
+		for fp, pkt := range x.protected {
+			c.protected[fp] = pkt
+		}
+	}
+	if x.bindings != nil {
+		c.bindings = make(map[[20]byte]*packet.Signature, len(x.bindings))
+		for fp, sig := range x.bindings {
+			c.bindings[fp] = sig
+		}
+	}
+	c.attributes = cloneSections(x.attributes)
+	c.unparsed = cloneSections(x.unparsed)
+	if x.agentKeys != nil {
+		c.agentKeys = make(map[[20]byte]*agentKey, len(x.agentKeys))
+		for fp, ak := range x.agentKeys {
+			c.agentKeys[fp] = ak
+		}
+	}
+	return c
+}
+
+func cloneSections(sections []*keySection) []*keySection {
+	var c []*keySection
+	for _, s := range sections {
+		cs := *s
+		cs.packets = append([][]byte(nil), s.packets...)
+		c = append(c, &cs)
+	}
+	return c
+}
+
+// public returns the extras of the public part of a key, leaving out
+// those of its secret keys. Unparsed secret subkeys are left out as well
+// since their public part cannot be told apart.
+func (x *keyExtras) public() *keyExtras {
+	if x == nil {
+		return nil
+	}
+	c := x.clone()
+	c.protected = nil
+	c.agentKeys = nil
+	c.unparsed = publicSections(c.unparsed)
+	return c
+}
+
+// publicSections returns the sections which do not hold a secret key.
+func publicSections(sections []*keySection) []*keySection {
+	var public []*keySection
+	for _, s := range sections {
+		if s.pkt == nil || (s.tag != tagSecretKey && s.tag != tagSecretSubkey) {
+			public = append(public, s)
+		}
+	}
+	return public
+}
+
+// readKeyExtras returns the extras of e found in the key block data it
+// was read from along with the sections of packets which were dropped
+// from it, or nil if there are none.
+func readKeyExtras(e *openpgp.Entity, data []byte, unparsed []*keySection) *keyExtras {
+	x := &keyExtras{}
+	if e.PrivateKey != nil {
+		x.protected = protectedPackets(data)
+	}
+	x.bindings = revokedSubkeyBindings(data)
+	x.attributes = userAttributeSections(data)
+	for _, s := range unparsed {
+		// user attributes are kept whole in attributes
+		if s.tag != tagUserAttribute {
+			x.unparsed = append(x.unparsed, s)
+		}
+	}
+	if len(x.protected) == 0 && len(x.bindings) == 0 && len(x.attributes) == 0 && len(x.unparsed) == 0 {
+		return nil
+	}
+	return x
+}
+
+// protectedPacket returns the protected packet of the secret key with
+// fingerprint fp, or nil if the key is not protected.
+func (x *keyExtras) protectedPacket(fp [20]byte) []byte {
+	if x == nil {
+		return nil
+	}
+	return x.protected[fp]
+}
+
+func (x *keyExtras) setProtected(fp [20]byte, pkt []byte) {
+	if x.protected == nil {
+		x.protected = make(map[[20]byte][]byte)
+	}
+	x.protected[fp] = pkt
+}
+
+// binding returns the binding signature of the revoked subkey with
+// fingerprint fp, or nil if it is not known.
+func (x *keyExtras) binding(fp [20]byte) *packet.Signature {
+	if x == nil {
+		return nil
+	}
+	return x.bindings[fp]
+}
+
+func (x *keyExtras) setBinding(fp [20]byte, sig *packet.Signature) {
+	if x.bindings == nil {
+		x.bindings = make(map[[20]byte]*packet.Signature)
+	}
+	x.bindings[fp] = sig
+}
+
+func (x *keyExtras) userAttributes() []*keySection {
+	if x == nil {
+		return nil
+	}
+	return x.attributes
+}
+
+// unparsedSignatures returns the signatures which cannot be parsed of the
+// key, user id or subkey with the given section id.
+func (x *keyExtras) unparsedSignatures(id string) [][]byte {
+	if x == nil {
+		return nil
+	}
+	for _, s := range x.unparsed {
+		if s.pkt == nil && s.id == id {
+			return s.packets
+		}
+	}
+	return nil
+}
+
+// unparsedSections returns the user ids which cannot be parsed if userIds
+// is set, or else the other dropped packets such as subkeys, along with
+// their signatures. Secret subkeys are only returned if secret is set.
+func (x *keyExtras) unparsedSections(userIds, secret bool) []*keySection {
+	if x == nil {
+		return nil
+	}
+	var sections []*keySection
+	for _, s := range x.unparsed {
+		if s.pkt == nil || (s.tag == tagUserId) != userIds || (!secret && s.tag == tagSecretSubkey) {
+			continue
+		}
+		sections = append(sections, s)
+	}
+	return sections
+}
+
+func (x *keyExtras) agentKey(fp [20]byte) *agentKey {
+	if x == nil {
+		return nil
+	}
+	return x.agentKeys[fp]
+}
+
+// setExtras stores x as the extras of e in place of those of old. Either
+// entity may be nil.
+func (kr *keyring) setExtras(old, e *openpgp.Entity, x *keyExtras) {
+	delete(kr.extras, old)
+	if e == nil || x == nil {
+		return
+	}
+	if kr.extras == nil {
+		kr.extras = make(map[*openpgp.Entity]*keyExtras)
+	}
+	kr.extras[e] = x
+}
+
+// extras returns the extras of e, which is a stored entity or a copy of
+// one, or nil if it has none. The lock must be held.
+func (store *keyStore) extras(e *openpgp.Entity) *keyExtras {
+	idx := store.publicIndex
+	if e.PrivateKey != nil {
+		idx = store.secretIndex
+	}
+	// copies of a stored entity share its key packets
+	if s := idx.lookupFingerprint(e.PrimaryKey.Fingerprint); s != nil && s.PrimaryKey == e.PrimaryKey {
+		e = s
+	}
+	if x := store.nyms.extras[e]; x != nil {
+		return x
+	}
+	return store.gnupg.extras[e]
+}
+
+// lookupExtras is like extras but takes the read lock.
+func (store *keyStore) lookupExtras(e *openpgp.Entity) *keyExtras {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.extras(e)
+}
@@ -0,0 +1,47 @@
+package keymgr
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp/armor"
+)
+
+func TestKeyExtrasStayWithTheirEntity(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	block, err := armor.Decode(strings.NewReader(testDataMap["user4"].seckey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nymsReport, gpgReport := &loadReport{}, &loadReport{}
+	nyms := readKeyringData("nymskeys.sec", 0, data, nymsReport)
+	gnupg := readKeyringData("secring.gpg", 0, data, gpgReport)
+	store := defaultKeys
+	store.setKeyrings(keyring{secret: nyms, extras: nymsReport.extras}, keyring{secret: gnupg, extras: gpgReport.extras})
+
+	x := store.extras(nyms[0])
+	if x.protectedPacket(nyms[0].PrimaryKey.Fingerprint) == nil {
+		t.Fatal("protected packet of loaded key not kept")
+	}
+	if store.extras(gnupg[0]) == x {
+		t.Error("nyms and GnuPG copies of a key share their extras")
+	}
+	if store.extras(copyEntity(nyms[0])) != x {
+		t.Error("extras not found for a copy of a stored key")
+	}
+
+	if err := RemoveSecretKey(nyms[0].PrimaryKey.Fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.nyms.extras) != 0 {
+		t.Error("extras of removed key are still stored")
+	}
+	if store.extras(gnupg[0]) == nil {
+		t.Error("removing the nyms copy dropped the extras of the GnuPG copy")
+	}
+}
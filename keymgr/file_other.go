@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package keymgr
+
+// lockFile does nothing on systems without flock. Writers in the same
+// process are still serialized by the key store lock.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
+
+// syncDirectory does nothing on systems where directories cannot be
+// synced.
+func syncDirectory(dir string) error {
+	return nil
+}
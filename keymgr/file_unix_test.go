@@ -0,0 +1,39 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package keymgr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	path := nymsPath(lockFilename)
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatalf("error taking lock: %v", err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := lockFile(path)
+		if err != nil {
+			t.Errorf("error taking lock: %v", err)
+		} else {
+			unlock()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock taken twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not taken after release")
+	}
+}
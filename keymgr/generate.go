@@ -0,0 +1,280 @@
+package keymgr
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"code.google.com/p/go.crypto/openpgp/s2k"
+)
+
+const defaultKeyBits = 2048
+
+var errCurve25519 = errors.New("EdDSA, ECDH and Curve25519 keys are not supported by the openpgp package")
+
+// KeyParams selects the algorithms and properties of a generated key. The
+// zero value selects a 2048 bit RSA key with an RSA encryption subkey.
+type KeyParams struct {
+	// Algorithm of the primary key and of the signing subkey, "rsa" or
+	// "ecdsa". The encryption subkey is always an RSA key since the
+	// openpgp package cannot encrypt to ECDH keys, and EdDSA and Curve25519
+	// keys are rejected since it cannot read them. Supporting them takes an
+	// OpenPGP implementation which handles them, shared with pgpmail since
+	// its KeySource hands out openpgp entities.
+	Algorithm string
+	// Bits is the size of RSA keys.
+	Bits int
+	// Curve is the curve of ECDSA keys, "p256", "p384" or "p521".
+	Curve string
+	// SigningSubkey adds a separate signing subkey. The primary key keeps
+	// its signing flag since the openpgp package always signs messages
+	// with the primary key.
+	SigningSubkey bool
+	// Lifetime is how long the key is valid after its creation, zero
+	// means it does not expire.
+	Lifetime time.Duration
+	// Ciphers, Hashes and Compression are the preferred algorithms in
+	// order of preference, by names such as "AES256", "SHA512" or "ZLIB".
+	Ciphers     []string
+	Hashes      []string
+	Compression []string
+	// Passphrase protects the secret keys, they are stored unprotected if
+	// it is empty.
+	Passphrase []byte
+}
+
+var defaultCiphers = []string{"AES256", "AES192", "AES128", "CAST5"}
+var defaultHashes = []string{"SHA256", "SHA512", "SHA384", "SHA224"}
+var defaultCompression = []string{"ZLIB", "ZIP", "Uncompressed"}
+
+var cipherIds = map[string]packet.CipherFunction{
+	"AES256": packet.CipherAES256,
+	"AES192": packet.CipherAES192,
+	"AES128": packet.CipherAES128,
+	"CAST5":  packet.CipherCAST5,
+	"3DES":   packet.Cipher3DES,
+}
+
+var hashFunctions = map[string]crypto.Hash{
+	"SHA512": crypto.SHA512,
+	"SHA384": crypto.SHA384,
+	"SHA256": crypto.SHA256,
+	"SHA224": crypto.SHA224,
+	"SHA1":   crypto.SHA1,
+}
+
+var compressionIds = map[string]packet.CompressionAlgo{
+	"UNCOMPRESSED": packet.CompressionNone,
+	"ZIP":          packet.CompressionZIP,
+	"ZLIB":         packet.CompressionZLIB,
+	"BZIP2":        3,
+}
+
+var curves = map[string]elliptic.Curve{
+	"p256": elliptic.P256(),
+	"p384": elliptic.P384(),
+	"p521": elliptic.P521(),
+}
+
+// GenerateKey creates a new key for the given user id with the algorithms
+// selected by params and stores it in the nyms keyring. A nil params
+// selects the defaults.
+func GenerateKey(name, comment, email string, params *KeyParams) (*openpgp.Entity, error) {
+	return generateNewKey(name, comment, email, params, nil)
+}
+
+// keyPreferences holds the preference subpackets and the signature hash
+// derived from KeyParams.
+type keyPreferences struct {
+	ciphers     []byte
+	hashes      []byte
+	compression []byte
+	hash        crypto.Hash
+}
+
+func (params *KeyParams) preferences() (*keyPreferences, error) {
+	prefs := &keyPreferences{}
+	for _, name := range nonEmpty(params.Ciphers, defaultCiphers) {
+		id, ok := cipherIds[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher %q", name)
+		}
+		prefs.ciphers = append(prefs.ciphers, byte(id))
+	}
+	for _, name := range nonEmpty(params.Hashes, defaultHashes) {
+		h, ok := hashFunctions[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown hash %q", name)
+		}
+		id, _ := s2k.HashToHashId(h)
+		prefs.hashes = append(prefs.hashes, id)
+		if prefs.hash == 0 && h.Available() {
+			prefs.hash = h
+		}
+	}
+	if prefs.hash == 0 {
+		prefs.hash = crypto.SHA256
+	}
+	for _, name := range nonEmpty(params.Compression, defaultCompression) {
+		id, ok := compressionIds[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown compression algorithm %q", name)
+		}
+		prefs.compression = append(prefs.compression, byte(id))
+	}
+	return prefs, nil
+}
+
+func nonEmpty(names, defaults []string) []string {
+	if len(names) == 0 {
+		return defaults
+	}
+	return names
+}
+
+func (params *KeyParams) bits() (int, error) {
+	if params.Bits == 0 {
+		return defaultKeyBits, nil
+	}
+	if params.Bits < 1024 || params.Bits > 8192 {
+		return 0, fmt.Errorf("unsupported RSA key size %d", params.Bits)
+	}
+	return params.Bits, nil
+}
+
+// newSigningKey generates a key of the algorithm selected by params for
+// the primary key or a signing subkey.
+func (params *KeyParams) newSigningKey(config *packet.Config) (*packet.PrivateKey, error) {
+	created := config.Now()
+	switch strings.ToLower(params.Algorithm) {
+	case "", "rsa":
+		return newRSAKey(params, config)
+	case "ecdsa":
+		curve := curves[strings.ToLower(params.Curve)]
+		if params.Curve == "" {
+			curve = elliptic.P256()
+		} else if curve == nil {
+			return nil, fmt.Errorf("unsupported curve %q", params.Curve)
+		}
+		k, err := ecdsa.GenerateKey(curve, config.Random())
+		if err != nil {
+			return nil, err
+		}
+		return packet.NewECDSAPrivateKey(created, k), nil
+	case "eddsa", "ed25519", "ecdh", "cv25519", "curve25519":
+		return nil, errCurve25519
+	}
+	return nil, fmt.Errorf("unsupported key algorithm %q", params.Algorithm)
+}
+
+func newRSAKey(params *KeyParams, config *packet.Config) (*packet.PrivateKey, error) {
+	bits, err := params.bits()
+	if err != nil {
+		return nil, err
+	}
+	k, err := rsa.GenerateKey(config.Random(), bits)
+	if err != nil {
+		return nil, err
+	}
+	return packet.NewRSAPrivateKey(config.Now(), k), nil
+}
+
+// newEntity generates a key as described by params. The self signatures
+// carry the key flags, expiration and algorithm preferences, and a signing
+// subkey is cross certified with a back signature.
+func newEntity(name, comment, email string, params *KeyParams, config *packet.Config) (*openpgp.Entity, error) {
+	if params == nil {
+		params = &KeyParams{}
+	}
+	uid := packet.NewUserId(name, comment, email)
+	if uid == nil {
+		return nil, fmt.Errorf("invalid characters in user id")
+	}
+	prefs, err := params.preferences()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLifetime(params.Lifetime); err != nil {
+		return nil, err
+	}
+	primary, err := params.newSigningKey(config)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := newRSAKey(params, config)
+	if err != nil {
+		return nil, err
+	}
+	var signing *packet.PrivateKey
+	if params.SigningSubkey {
+		if signing, err = params.newSigningKey(config); err != nil {
+			return nil, err
+		}
+	}
+
+	created, rand := config.Now(), config.Random()
+	e := &openpgp.Entity{
+		PrimaryKey: &primary.PublicKey,
+		PrivateKey: primary,
+		Identities: make(map[string]*openpgp.Identity),
+	}
+
+	b := newSignatureBuilder(packet.SigTypePositiveCert, prefs.hash, created)
+	b.add(subpacketKeyFlags, keyFlagCertify|keyFlagSign)
+	b.addLifetime(subpacketKeyExpiration, params.Lifetime)
+	b.add(subpacketPrefSymmetric, prefs.ciphers...)
+	b.add(subpacketPrefHash, prefs.hashes...)
+	b.add(subpacketPrefCompression, prefs.compression...)
+	b.add(subpacketFeatures, featureMDC)
+	b.add(subpacketPrimaryUserId, 1)
+	sig, err := b.signUserId(uid.Id, e.PrimaryKey, primary, rand)
+	if err != nil {
+		return nil, err
+	}
+	e.Identities[uid.Id] = &openpgp.Identity{Name: uid.Id, UserId: uid, SelfSignature: sig}
+
+	sk, err := bindSubkey(e, encryption, keyFlagEncryptCommunications|keyFlagEncryptStorage, params.Lifetime, prefs.hash, created, rand)
+	if err != nil {
+		return nil, err
+	}
+	e.Subkeys = append(e.Subkeys, sk)
+	if signing != nil {
+		sk, err := bindSubkey(e, signing, keyFlagSign, params.Lifetime, prefs.hash, created, rand)
+		if err != nil {
+			return nil, err
+		}
+		e.Subkeys = append(e.Subkeys, sk)
+	}
+	return e, nil
+}
+
+// bindSubkey signs the binding of priv to e as a subkey with the given
+// key flags. Signing subkeys get an embedded back signature.
+func bindSubkey(e *openpgp.Entity, priv *packet.PrivateKey, flags byte, lifetime time.Duration, h crypto.Hash, created time.Time, rand io.Reader) (openpgp.Subkey, error) {
+	priv.IsSubkey = true
+	priv.PublicKey.IsSubkey = true
+	b := newSignatureBuilder(packet.SigTypeSubkeyBinding, h, created)
+	b.add(subpacketKeyFlags, flags)
+	b.addLifetime(subpacketKeyExpiration, lifetime)
+	if flags&keyFlagSign != 0 {
+		back := newSignatureBuilder(packet.SigTypePrimaryKeyBinding, h, created)
+		body, err := back.signKeyBody(e.PrimaryKey, &priv.PublicKey, priv, rand)
+		if err != nil {
+			return openpgp.Subkey{}, err
+		}
+		b.add(subpacketEmbeddedSignature, body...)
+	}
+	sig, err := b.signKey(e.PrimaryKey, &priv.PublicKey, e.PrivateKey, rand)
+	if err != nil {
+		return openpgp.Subkey{}, err
+	}
+	return openpgp.Subkey{PublicKey: &priv.PublicKey, PrivateKey: priv, Sig: sig}, nil
+}
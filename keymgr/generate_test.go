@@ -0,0 +1,112 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// roundTrip serializes e with its secret keys and reads it back, which
+// verifies all self signatures.
+func roundTrip(t *testing.T, e *openpgp.Entity) *openpgp.Entity {
+	b := &bytes.Buffer{}
+	if err := serializeEntity(b, e, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	e, err := openpgp.ReadEntity(packet.NewReader(b))
+	if err != nil {
+		t.Fatalf("error reading generated key: %v", err)
+	}
+	return e
+}
+
+func TestGenerateKeyPreferences(t *testing.T) {
+	params := &KeyParams{
+		Bits:        1024,
+		Ciphers:     []string{"aes128", "AES256"},
+		Hashes:      []string{"SHA512"},
+		Compression: []string{"Uncompressed"},
+	}
+	e, err := newEntity("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = roundTrip(t, e)
+	sig := e.Identities["foo <foo@bar.com>"].SelfSignature
+	if !bytes.Equal(sig.PreferredSymmetric, []byte{7, 9}) {
+		t.Errorf("preferred ciphers are %v", sig.PreferredSymmetric)
+	}
+	if !bytes.Equal(sig.PreferredHash, []byte{10}) || sig.Hash != crypto.SHA512 {
+		t.Errorf("preferred hashes are %v, signed with %v", sig.PreferredHash, sig.Hash)
+	}
+	if !bytes.Equal(sig.PreferredCompression, []byte{0}) {
+		t.Errorf("preferred compression is %v", sig.PreferredCompression)
+	}
+	if !sig.MDC || !sig.FlagCertify || !sig.FlagSign || sig.KeyLifetimeSecs != nil {
+		t.Errorf("unexpected self signature flags")
+	}
+	if len(e.Subkeys) != 1 || !e.Subkeys[0].Sig.FlagEncryptCommunications {
+		t.Errorf("expecting a single encryption subkey")
+	}
+}
+
+func TestGenerateECDSAKeyWithSigningSubkey(t *testing.T) {
+	params := &KeyParams{
+		Algorithm:     "ecdsa",
+		Curve:         "p384",
+		Bits:          1024,
+		SigningSubkey: true,
+		Lifetime:      365 * 24 * time.Hour,
+	}
+	e, err := newEntity("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = roundTrip(t, e)
+	if e.PrimaryKey.PubKeyAlgo != packet.PubKeyAlgoECDSA {
+		t.Errorf("primary key algorithm is %v", e.PrimaryKey.PubKeyAlgo)
+	}
+	sig := e.Identities["foo <foo@bar.com>"].SelfSignature
+	if sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs != 365*24*3600 {
+		t.Error("unexpected primary key self signature")
+	}
+	if len(e.Subkeys) != 2 || !e.Subkeys[1].Sig.FlagSign || e.Subkeys[1].Sig.EmbeddedSignature == nil {
+		t.Fatal("expecting a cross certified signing subkey")
+	}
+
+	// openpgp.DetachSign signs with the private key of the entity passed
+	subkeySigner := *e
+	subkeySigner.PrivateKey = e.Subkeys[1].PrivateKey
+	for _, signer := range []*openpgp.Entity{e, &subkeySigner} {
+		msg := []byte("signed message")
+		out := &bytes.Buffer{}
+		if err := openpgp.DetachSign(out, signer, bytes.NewReader(msg), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openpgp.CheckDetachedSignature(openpgp.EntityList{e}, bytes.NewReader(msg), out); err != nil {
+			t.Errorf("signature by key %X did not verify: %v", signer.PrivateKey.KeyId, err)
+		}
+	}
+}
+
+func TestGenerateKeyInvalidParams(t *testing.T) {
+	for _, params := range []*KeyParams{
+		{Algorithm: "eddsa"},
+		{Algorithm: "ecdsa", Curve: "brainpool"},
+		{Bits: 512},
+		{Ciphers: []string{"IDEA"}},
+	} {
+		if _, err := newEntity("foo", "", "foo@bar.com", params, nil); err == nil {
+			t.Errorf("no error generating key with %+v", params)
+		}
+	}
+	for _, algo := range []string{"ed25519", "cv25519", "ecdh"} {
+		if _, err := newEntity("foo", "", "foo@bar.com", &KeyParams{Algorithm: algo}, nil); err != errCurve25519 {
+			t.Errorf("generating %s key: expecting %v, got %v", algo, errCurve25519, err)
+		}
+	}
+}
@@ -2,48 +2,85 @@ package keymgr
 
 import (
 	"errors"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 
 	"code.google.com/p/go.crypto/openpgp"
+	pgperrors "code.google.com/p/go.crypto/openpgp/errors"
+	"code.google.com/p/go.crypto/openpgp/packet"
 )
 
-const pubring = ".gnupg/pubring.gpg"
-const secring = ".gnupg/secring.gpg"
+const pubring = "pubring.gpg"
+const secring = "secring.gpg"
+const keybox = "pubring.kbx"
+const privateKeysDirectory = "private-keys-v1.d"
 
-var publicEntities openpgp.EntityList
-var secretEntities openpgp.EntityList
-
-func LoadDefaultKeyring() error {
+// gnupgHome returns the GnuPG home directory, honoring $GNUPGHOME.
+func gnupgHome() (string, error) {
+	if home := os.Getenv("GNUPGHOME"); home != "" {
+		return home, nil
+	}
 	u, err := user.Current()
 	if err != nil {
-		return err
+		return "", err
 	}
-	pubpath := filepath.Join(u.HomeDir, pubring)
-	secpath := filepath.Join(u.HomeDir, secring)
-	publicEntities, err = loadKeyringFile(pubpath)
+	return filepath.Join(u.HomeDir, ".gnupg"), nil
+}
+
+// loadGnupgKeyrings reads the public and secret keys of a GnuPG home
+// directory. Both the legacy pubring.gpg/secring.gpg layout and the
+// pubring.kbx/private-keys-v1.d layout of GnuPG 2.1 and later are
+// supported.
+func loadGnupgKeyrings(r *loadReport) (pub, sec openpgp.EntityList, err error) {
+	home, err := gnupgHome()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	secretEntities, err = loadKeyringFile(secpath)
+	pub, err = loadGnupgPublicKeys(home, r)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	return nil
+	legacy, err := loadOptionalKeyringFile(filepath.Join(home, secring), r)
+	if err != nil {
+		return nil, nil, err
+	}
+	agent, err := loadAgentSecretKeys(filepath.Join(home, privateKeysDirectory), pub, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub, mergeKeyrings(agent, legacy), nil
 }
 
-func loadKeyringFile(path string) (openpgp.EntityList, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// loadGnupgPublicKeys reads pubring.kbx, or pubring.gpg if there is no
+// keybox, which is the same choice GnuPG 2.1+ makes.
+func loadGnupgPublicKeys(home string, r *loadReport) (openpgp.EntityList, error) {
+	el, err := loadKeyboxFile(filepath.Join(home, keybox), r)
+	if os.IsNotExist(err) {
+		return loadOptionalKeyringFile(filepath.Join(home, pubring), r)
 	}
-	defer f.Close()
-	el, err := openpgp.ReadKeyRing(f)
+	return el, err
+}
+
+// loadKeyringFile reads a binary keyring. Keys which cannot be parsed are
+// skipped and reported to r rather than failing the whole file.
+func loadKeyringFile(path string, r *loadReport) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return el, nil
+	return readKeyringData(path, 0, data, r), nil
+}
+
+// loadOptionalKeyringFile is like loadKeyringFile but treats a missing
+// file as an empty keyring.
+func loadOptionalKeyringFile(path string, r *loadReport) (openpgp.EntityList, error) {
+	el, err := loadKeyringFile(path, r)
+	if os.IsNotExist(err) {
+		return openpgp.EntityList{}, nil
+	}
+	return el, err
 }
 
 func UnlockPrivateKey(e *openpgp.Entity, passphrase []byte) (bool, error) {
@@ -54,20 +91,43 @@ func UnlockPrivateKey(e *openpgp.Entity, passphrase []byte) (bool, error) {
 		return true, nil
 	}
 
-	err := e.PrivateKey.Decrypt(passphrase)
+	// the keys are decrypted in place, which readers of a stored entity
+	// must not see half done
+	defaultKeys.lock.Lock()
+	defer defaultKeys.lock.Unlock()
+	x := defaultKeys.extras(e)
+	err := decryptPrivateKey(e.PrivateKey, x, passphrase)
 	if err == nil {
-		decryptSubkeys(e, passphrase)
+		err = decryptSubkeys(e, x, passphrase)
+	}
+	if err == errWrongPassphrase {
+		return false, nil
 	}
-	return (err == nil), nil
+	return err == nil, err
 }
 
-func decryptSubkeys(e *openpgp.Entity, passphrase []byte) {
-	if e.Subkeys == nil {
-		return
-	}
+func decryptSubkeys(e *openpgp.Entity, x *keyExtras, passphrase []byte) error {
 	for _, sk := range e.Subkeys {
 		if sk.PrivateKey != nil && sk.PrivateKey.Encrypted {
-			sk.PrivateKey.Decrypt(passphrase)
+			if err := decryptPrivateKey(sk.PrivateKey, x, passphrase); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
+
+// decryptPrivateKey unlocks k with passphrase, using the agent key in x
+// for keys stored by gpg-agent. It returns errWrongPassphrase if the
+// passphrase does not unlock k and other errors if k cannot be unlocked
+// at all, for example because its protection is not supported.
+func decryptPrivateKey(k *packet.PrivateKey, x *keyExtras, passphrase []byte) error {
+	if ak := x.agentKey(k.Fingerprint); ak != nil {
+		return ak.unlock(k, passphrase)
+	}
+	err := k.Decrypt(passphrase)
+	if _, ok := err.(pgperrors.StructuralError); ok {
+		return errWrongPassphrase
+	}
+	return err
 }
@@ -0,0 +1,141 @@
+package keymgr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/armor"
+)
+
+// Outcomes of importing a key
+const (
+	ImportNew       = "new"
+	ImportUpdated   = "updated"
+	ImportUnchanged = "unchanged"
+	ImportRejected  = "rejected"
+)
+
+// ImportResult reports what happened to one key passed to ImportKeys.
+// Reason explains a rejected key, or lists the parts of an imported key
+// which cannot be used.
+type ImportResult struct {
+	Fingerprint string
+	Status      string
+	Reason      string
+}
+
+const importSource = "imported key data"
+
+// ImportKeys reads one or more armored or binary key blocks from data and
+// stores the keys in the nyms keyrings. Only keys with valid self
+// signatures are accepted. A key which is already known is merged with the
+// imported one, adding new user ids, subkeys and signatures.
+func ImportKeys(data []byte) ([]ImportResult, error) {
+	blocks, err := decodeKeyBlocks(data)
+	if err != nil {
+		return nil, err
+	}
+	r := &loadReport{}
+	var keys openpgp.EntityList
+	for _, b := range blocks {
+		keys = append(keys, readKeyringData(importSource, 0, b, r)...)
+	}
+
+	var results []ImportResult
+	notes := make(map[string][]string)
+	for _, d := range r.diagnostics {
+		notes[d.Fingerprint] = append(notes[d.Fingerprint], d.Reason)
+	}
+	err = defaultKeys.update(func(store *keyStore) error {
+		for _, e := range keys {
+			fp := hex.EncodeToString(e.PrimaryKey.Fingerprint[:])
+			status, err := store.importKey(e, r.extras[e])
+			if err != nil {
+				return err
+			}
+			results = append(results, ImportResult{
+				Fingerprint: fp,
+				Status:      status,
+				Reason:      strings.Join(notes[fp], "; "),
+			})
+			delete(notes, fp)
+		}
+		return nil
+	})
+	for _, d := range r.diagnostics {
+		if reasons, ok := notes[d.Fingerprint]; ok {
+			results = append(results, ImportResult{
+				Fingerprint: d.Fingerprint,
+				Status:      ImportRejected,
+				Reason:      strings.Join(reasons, "; "),
+			})
+			delete(notes, d.Fingerprint)
+		}
+	}
+	return results, err
+}
+
+// importKey merges e with its extras x into the nyms keyrings, the secret
+// keyring as well if e has a secret key.
+func (store *keyStore) importKey(e *openpgp.Entity, x *keyExtras) (string, error) {
+	status, err := store.importInto(publicEntity(e), x.public(), false)
+	if err != nil || e.PrivateKey == nil {
+		return status, err
+	}
+	secretStatus, err := store.importInto(e, x, true)
+	if status == ImportUnchanged || secretStatus == ImportNew {
+		status = secretStatus
+	}
+	return status, err
+}
+
+// importInto merges e with its extras x into the public or secret nyms
+// keyring. Keys which are only in the GnuPG keyrings are not merged, so
+// none of their data is copied to the nyms keyrings.
+func (store *keyStore) importInto(e *openpgp.Entity, x *keyExtras, secret bool) (string, error) {
+	old := findEntity(*store.nymsList(secret), e.PrimaryKey.Fingerprint)
+	if old == nil {
+		return ImportNew, store.add(e, x, secret)
+	}
+	mx := store.nyms.extras[old].clone()
+	merged, changed := mergeEntity(old, e, mx)
+	mx, extrasChanged := mergeExtras(mx, x, merged)
+	if !changed && !extrasChanged {
+		return ImportUnchanged, nil
+	}
+	return ImportUpdated, store.replace(merged, mx, secret)
+}
+
+// decodeKeyBlocks returns the binary key data of every armored block in
+// data, or data itself if it is not armored.
+func decodeKeyBlocks(data []byte) ([][]byte, error) {
+	const armorStart = "-----BEGIN PGP"
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte(armorStart)) {
+		return [][]byte{data}, nil
+	}
+	var blocks [][]byte
+	for {
+		i := bytes.Index(data, []byte(armorStart))
+		if i == -1 {
+			return blocks, nil
+		}
+		data = data[i:]
+		block, err := armor.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding armored key block: %v", err)
+		}
+		if block.Type != publicKeyArmorHeader && block.Type != secretKeyArmorHeader {
+			return nil, fmt.Errorf("armored block is a %s, not a key", block.Type)
+		}
+		b, err := ioutil.ReadAll(block.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding armored key block: %v", err)
+		}
+		blocks = append(blocks, b)
+		data = data[len(armorStart):]
+	}
+}
@@ -0,0 +1,144 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func armoredPublicKey(t *testing.T, e *openpgp.Entity) []byte {
+	s, err := ArmorPublicKey(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(s)
+}
+
+// withUserId returns a copy of the secret key e with an additional user id.
+func withUserId(t *testing.T, e *openpgp.Entity, name, email string) *openpgp.Entity {
+	uid := packet.NewUserId(name, "", email)
+	b := newSignatureBuilder(packet.SigTypePositiveCert, crypto.SHA256, time.Now())
+	sig, err := b.signUserId(uid.Id, e.PrimaryKey, e.PrivateKey, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := copyEntity(e)
+	c.Identities[uid.Id] = &openpgp.Identity{Name: uid.Id, UserId: uid, SelfSignature: sig}
+	return c
+}
+
+func expectImport(t *testing.T, data []byte, statuses ...string) []ImportResult {
+	results, err := ImportKeys(data)
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if len(results) != len(statuses) {
+		t.Fatalf("expecting %d results, got %v", len(statuses), results)
+	}
+	for i, s := range statuses {
+		if results[i].Status != s {
+			t.Errorf("key %s: status is %s, expecting %s (%s)", results[i].Fingerprint, results[i].Status, s, results[i].Reason)
+		}
+	}
+	return results
+}
+
+func TestImportKeys(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	user1 := toEntity(testDataMap["user1"].pubkey)
+	user2 := toEntity(testDataMap["user2"].pubkey)
+
+	data := append(armoredPublicKey(t, user1), armoredPublicKey(t, user2)...)
+	expectImport(t, data, ImportNew, ImportNew)
+	expectImport(t, armoredPublicKey(t, user1), ImportUnchanged)
+
+	sec := toEntity(testDataMap["user1"].seckey)
+	updated := withUserId(t, sec, "Other User 1", "other1@example.com")
+	expectImport(t, armoredPublicKey(t, updated), ImportUpdated)
+	k, _ := KeySource().GetPublicKey("other1@example.com")
+	if k == nil || k.PrimaryKey.Fingerprint != user1.PrimaryKey.Fingerprint {
+		t.Fatal("merged user id not found")
+	}
+	if len(k.Identities) != len(user1.Identities)+1 {
+		t.Errorf("merged key has %d user ids", len(k.Identities))
+	}
+}
+
+func TestImportIgnoresGnupgKeys(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	user1 := toEntity(testDataMap["user1"].pubkey)
+	gnupg := withUserId(t, toEntity(testDataMap["user1"].seckey), "GnuPG User 1", "gnupg1@example.com")
+	defaultKeys.setKeyrings(keyring{}, keyring{public: openpgp.EntityList{publicEntity(gnupg)}})
+
+	expectImport(t, armoredPublicKey(t, user1), ImportNew)
+	nyms, _, _ := loadKeyrings()
+	if len(nyms.public) != 1 || len(nyms.public[0].Identities) != len(user1.Identities) {
+		t.Error("imported key was merged with the GnuPG copy")
+	}
+}
+
+func TestImportSubkeyRevocation(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	sec := toEntity(testDataMap["user1"].seckey)
+	sk := sec.Subkeys[0]
+	fp := sk.PublicKey.Fingerprint
+	now := time.Now()
+	revocation, err := newRevocationBuilder(packet.SigTypeSubkeyRevocation, ReasonRetired, "", now.Add(-time.Hour)).signKey(sec.PrimaryKey, sk.PublicKey, sec.PrivateKey, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binding, err := rebindSubkey(sec.PrimaryKey, sk, sec.PrivateKey, crypto.SHA256, now, 0, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSubkeySig := func(sig *packet.Signature) *openpgp.Entity {
+		c := copyEntity(publicEntity(sec))
+		c.Subkeys[0].Sig = sig
+		return c
+	}
+
+	expectImport(t, armoredPublicKey(t, withSubkeySig(binding)), ImportNew)
+	expectImport(t, armoredPublicKey(t, withSubkeySig(revocation)), ImportUpdated)
+	expectImport(t, armoredPublicKey(t, withSubkeySig(binding)), ImportUnchanged)
+
+	nyms, _, err := loadKeyrings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := nyms.public[0]
+	if k.Subkeys[0].Sig.SigType != packet.SigTypeSubkeyRevocation {
+		t.Error("revocation older than the stored binding was not merged")
+	}
+	if b := nyms.extras[k].binding(fp); b == nil || !bytes.Equal(signatureBytes(b), signatureBytes(binding)) {
+		t.Error("binding replaced by the revocation was not kept")
+	}
+}
+
+func TestImportRejectsInvalidKeys(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	e := copyEntity(toEntity(testDataMap["user1"].pubkey))
+	for _, ident := range e.Identities {
+		uid := packet.NewUserId("Forged", "", "forged@example.com")
+		e.Identities[uid.Id] = &openpgp.Identity{Name: uid.Id, UserId: uid, SelfSignature: ident.SelfSignature}
+		break
+	}
+	b := &bytes.Buffer{}
+	if err := serializeEntity(b, e, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	b.Write(ed25519PublicKeyPacket(tagPublicKey))
+	results := expectImport(t, b.Bytes(), ImportRejected, ImportRejected)
+	for _, r := range results {
+		if r.Reason == "" {
+			t.Errorf("no reason given for rejecting %s", r.Fingerprint)
+		}
+	}
+	if k, _ := KeySource().GetPublicKey("forged@example.com"); k != nil {
+		t.Error("key with forged user id was imported")
+	}
+}
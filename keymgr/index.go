@@ -0,0 +1,129 @@
+package keymgr
+
+import (
+	"code.google.com/p/go.crypto/openpgp"
+)
+
+// keyIndex maps normalized email addresses, key ids of primary keys and
+// subkeys, and fingerprints to the entities of a key list. A nil index is
+// empty. With matchSubaddresses set an address with a subaddress matches
+// the keys of its base address when it has no keys of its own.
+type keyIndex struct {
+	byEmail           map[string]openpgp.EntityList
+	byKeyId           map[uint64]openpgp.EntityList
+	byFingerprint     map[[20]byte]*openpgp.Entity
+	matchSubaddresses bool
+}
+
+func newKeyIndex(el openpgp.EntityList) *keyIndex {
+	idx := &keyIndex{
+		byEmail:       make(map[string]openpgp.EntityList),
+		byKeyId:       make(map[uint64]openpgp.EntityList),
+		byFingerprint: make(map[[20]byte]*openpgp.Entity, len(el)),
+	}
+	for _, e := range el {
+		idx.add(e)
+	}
+	return idx
+}
+
+func (idx *keyIndex) add(e *openpgp.Entity) {
+	idx.byFingerprint[e.PrimaryKey.Fingerprint] = e
+	for _, email := range entityEmails(e) {
+		idx.byEmail[email] = append(idx.byEmail[email], e)
+	}
+	for _, id := range entityKeyIds(e) {
+		idx.byKeyId[id] = append(idx.byKeyId[id], e)
+	}
+}
+
+func (idx *keyIndex) remove(e *openpgp.Entity) {
+	delete(idx.byFingerprint, e.PrimaryKey.Fingerprint)
+	for _, email := range entityEmails(e) {
+		if el := withoutEntity(idx.byEmail[email], e); len(el) > 0 {
+			idx.byEmail[email] = el
+		} else {
+			delete(idx.byEmail, email)
+		}
+	}
+	for _, id := range entityKeyIds(e) {
+		if el := withoutEntity(idx.byKeyId[id], e); len(el) > 0 {
+			idx.byKeyId[id] = el
+		} else {
+			delete(idx.byKeyId, id)
+		}
+	}
+}
+
+// lookupEmail returns the entities with a user id for email. With
+// subaddress matching enabled the base address is tried if there are none.
+func (idx *keyIndex) lookupEmail(email string) openpgp.EntityList {
+	if idx == nil {
+		return nil
+	}
+	email = normalizeEmail(email)
+	if el := idx.byEmail[email]; len(el) > 0 || !idx.matchSubaddresses {
+		return el
+	}
+	if base := baseAddress(email); base != email {
+		return idx.byEmail[base]
+	}
+	return nil
+}
+
+func (idx *keyIndex) lookupKeyId(id uint64) openpgp.EntityList {
+	if idx == nil {
+		return nil
+	}
+	return idx.byKeyId[id]
+}
+
+func (idx *keyIndex) lookupFingerprint(fp [20]byte) *openpgp.Entity {
+	if idx == nil {
+		return nil
+	}
+	return idx.byFingerprint[fp]
+}
+
+// entityEmails returns the distinct normalized email addresses of the
+// user ids of e which are not revoked.
+func entityEmails(e *openpgp.Entity) []string {
+	var emails []string
+	for name, ident := range e.Identities {
+		if isUserIdRevoked(e, name, ident) {
+			continue
+		}
+		email := normalizeEmail(userIdEmail(ident.UserId))
+		if email != "" && !containsString(emails, email) {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+func entityKeyIds(e *openpgp.Entity) []uint64 {
+	ids := []uint64{e.PrimaryKey.KeyId}
+	for _, sk := range e.Subkeys {
+		ids = append(ids, sk.PublicKey.KeyId)
+	}
+	return ids
+}
+
+func withoutEntity(el openpgp.EntityList, e *openpgp.Entity) openpgp.EntityList {
+	result := make(openpgp.EntityList, 0, len(el))
+	for _, v := range el {
+		if v != e {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
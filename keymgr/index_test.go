@@ -0,0 +1,127 @@
+package keymgr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestIndexLookups(t *testing.T) {
+	el := syntheticKeyring(100)
+	idx := newKeyIndex(el)
+	e := el[42]
+	if got := idx.lookupEmail(" User42@Example.COM "); len(got) != 1 || got[0] != e {
+		t.Errorf("email lookup returned %v", got)
+	}
+	if got := idx.lookupKeyId(e.PrimaryKey.KeyId); len(got) != 1 || got[0] != e {
+		t.Errorf("key id lookup returned %v", got)
+	}
+	if got := idx.lookupKeyId(e.Subkeys[0].PublicKey.KeyId); len(got) != 1 || got[0] != e {
+		t.Errorf("subkey id lookup returned %v", got)
+	}
+	if got := idx.lookupFingerprint(e.PrimaryKey.Fingerprint); got != e {
+		t.Errorf("fingerprint lookup returned %v", got)
+	}
+
+	idx.remove(e)
+	if got := idx.lookupEmail("user42@example.com"); len(got) != 0 {
+		t.Errorf("removed entity still found by email: %v", got)
+	}
+	if got := idx.lookupKeyId(e.Subkeys[0].PublicKey.KeyId); len(got) != 0 {
+		t.Errorf("removed entity still found by subkey id: %v", got)
+	}
+	if idx.lookupFingerprint(e.PrimaryKey.Fingerprint) != nil {
+		t.Error("removed entity still found by fingerprint")
+	}
+}
+
+func TestRefreshMerged(t *testing.T) {
+	nyms, gnupg := syntheticKeyring(3), syntheticKeyring(3)
+	store := &keyStore{nyms: keyring{public: nyms[:1]}, gnupg: keyring{public: gnupg}}
+	store.rebuild()
+	fp := nyms[1].PrimaryKey.Fingerprint
+
+	// nyms now has its own copy of a key gnupg also holds
+	store.nyms.public = nyms[:2]
+	store.refresh(fp)
+	if len(store.publicKeys) != 3 || store.publicKeys[1] != nyms[1] {
+		t.Fatalf("merged view not updated: %v", store.publicKeys)
+	}
+	if got := store.lookupPublicKey("user1@example.com"); len(got) != 1 || got[0] != nyms[1] {
+		t.Errorf("lookup returned %v, expected nyms entity", got)
+	}
+
+	// dropping it from nyms makes the gnupg copy visible again
+	store.nyms.public = nyms[:1]
+	store.refresh(fp)
+	if got := store.lookupPublicKey("user1@example.com"); len(got) != 1 || got[0] != gnupg[1] {
+		t.Errorf("lookup returned %v, expected gnupg entity", got)
+	}
+}
+
+// syntheticKeyring returns n entities with a single identity and subkey
+// each. The keys are not usable for any cryptographic operation.
+func syntheticKeyring(n int) openpgp.EntityList {
+	el := make(openpgp.EntityList, n)
+	for i := range el {
+		pk := &packet.PublicKey{KeyId: uint64(i) << 1}
+		binary.BigEndian.PutUint64(pk.Fingerprint[12:], pk.KeyId)
+		sub := &packet.PublicKey{KeyId: uint64(i)<<1 | 1}
+		binary.BigEndian.PutUint64(sub.Fingerprint[12:], sub.KeyId)
+		uid := packet.NewUserId(fmt.Sprintf("User %d", i), "", fmt.Sprintf("user%d@example.com", i))
+		el[i] = &openpgp.Entity{
+			PrimaryKey: pk,
+			Identities: map[string]*openpgp.Identity{uid.Id: {Name: uid.Id, UserId: uid}},
+			Subkeys:    []openpgp.Subkey{{PublicKey: sub}},
+		}
+	}
+	return el
+}
+
+// linearLookup is the scan over all identities which the index replaces.
+func linearLookup(email string, el openpgp.EntityList) openpgp.EntityList {
+	var result openpgp.EntityList
+	for _, e := range el {
+		for _, ident := range e.Identities {
+			if ident.UserId.Email == email {
+				result = append(result, e)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func benchmarkLookup(b *testing.B, n int, indexed bool) {
+	el := syntheticKeyring(n)
+	idx := newKeyIndex(el)
+	email := fmt.Sprintf("user%d@example.com", n-1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if indexed {
+			idx.lookupEmail(email)
+		} else {
+			linearLookup(email, el)
+		}
+	}
+}
+
+func BenchmarkLinearLookup100(b *testing.B)    { benchmarkLookup(b, 100, false) }
+func BenchmarkLinearLookup1000(b *testing.B)   { benchmarkLookup(b, 1000, false) }
+func BenchmarkLinearLookup10000(b *testing.B)  { benchmarkLookup(b, 10000, false) }
+func BenchmarkLinearLookup40000(b *testing.B)  { benchmarkLookup(b, 40000, false) }
+func BenchmarkIndexedLookup100(b *testing.B)   { benchmarkLookup(b, 100, true) }
+func BenchmarkIndexedLookup1000(b *testing.B)  { benchmarkLookup(b, 1000, true) }
+func BenchmarkIndexedLookup10000(b *testing.B) { benchmarkLookup(b, 10000, true) }
+func BenchmarkIndexedLookup40000(b *testing.B) { benchmarkLookup(b, 40000, true) }
+
+func BenchmarkIndexRebuild40000(b *testing.B) {
+	el := syntheticKeyring(40000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newKeyIndex(el)
+	}
+}
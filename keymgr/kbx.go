@@ -0,0 +1,84 @@
+package keymgr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"code.google.com/p/go.crypto/openpgp"
+)
+
+// Keybox blob types and flags as described in kbx/keybox-blob.c of GnuPG
+const (
+	kbxBlobOpenPGP   = 2
+	kbxFlagEphemeral = 2
+
+	kbxMinBlobLength = 16
+)
+
+// loadKeyboxFile reads all OpenPGP keys stored in a GnuPG 2.1+ keybox file
+// such as pubring.kbx. Blobs and keys which cannot be parsed are skipped
+// and reported to r.
+func loadKeyboxFile(path string, r *loadReport) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	el := openpgp.EntityList{}
+	for _, b := range readKeybox(path, data, r) {
+		el = append(el, readKeyringData(path, b.offset, b.data, r)...)
+	}
+	return el, nil
+}
+
+// readKeybox returns the OpenPGP keyblocks contained in a keybox along with
+// their offsets in the file. X.509 certificates and ephemeral keys are
+// skipped, as are damaged blobs which are reported to r. A damaged blob
+// length ends the keybox.
+func readKeybox(path string, data []byte, r *loadReport) []keyBlock {
+	var blocks []keyBlock
+	for off := 0; off < len(data); {
+		if len(data)-off < 5 {
+			r.skip(path, off, [20]byte{}, errors.New("truncated keybox blob"))
+			break
+		}
+		n := int(binary.BigEndian.Uint32(data[off:]))
+		if n < 5 || n > len(data)-off {
+			r.skip(path, off, [20]byte{}, fmt.Errorf("invalid keybox blob length %d", n))
+			break
+		}
+		blob := data[off : off+n]
+		if blob[4] == kbxBlobOpenPGP {
+			start, kb, err := keyblockFromBlob(blob)
+			if err != nil {
+				r.skip(path, off, [20]byte{}, err)
+			} else if kb != nil {
+				blocks = append(blocks, keyBlock{offset: off + start, data: kb})
+			}
+		}
+		off += n
+	}
+	return blocks
+}
+
+// keyblockFromBlob returns the keyblock of an OpenPGP blob and its offset
+// in the blob, or nil for ephemeral keys.
+func keyblockFromBlob(blob []byte) (int, []byte, error) {
+	if len(blob) < kbxMinBlobLength {
+		return 0, nil, fmt.Errorf("blob too short (%d bytes)", len(blob))
+	}
+	if version := blob[5]; version != 1 {
+		return 0, nil, fmt.Errorf("unsupported blob version %d", version)
+	}
+	flags := binary.BigEndian.Uint16(blob[6:])
+	if flags&kbxFlagEphemeral != 0 {
+		return 0, nil, nil
+	}
+	start := int(binary.BigEndian.Uint32(blob[8:]))
+	length := int(binary.BigEndian.Uint32(blob[12:]))
+	if start < kbxMinBlobLength || length < 0 || start+length > len(blob) {
+		return 0, nil, fmt.Errorf("keyblock (offset %d, length %d) exceeds blob", start, length)
+	}
+	return start, blob[start : start+length], nil
+}
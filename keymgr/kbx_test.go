@@ -0,0 +1,58 @@
+package keymgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadKeybox(t *testing.T) {
+	e := toEntity(testDataMap["user1"].pubkey)
+	keyblock := &bytes.Buffer{}
+	if err := e.Serialize(keyblock); err != nil {
+		t.Fatal(err)
+	}
+	kbx := &bytes.Buffer{}
+	writeTestBlob(kbx, 1, 0, []byte("KBXf"))
+	writeTestBlob(kbx, kbxBlobOpenPGP, 0, keyblock.Bytes())
+	writeTestBlob(kbx, kbxBlobOpenPGP, kbxFlagEphemeral, keyblock.Bytes())
+
+	r := &loadReport{}
+	blocks := readKeybox("pubring.kbx", kbx.Bytes(), r)
+	if len(r.diagnostics) != 0 {
+		t.Fatalf("unexpected diagnostics reading keybox: %v", r.diagnostics)
+	}
+	if len(blocks) != 1 {
+		t.Fatalf("expecting 1 keyblock, got %d", len(blocks))
+	}
+	if !bytes.Equal(blocks[0].data, keyblock.Bytes()) {
+		t.Error("keyblock read from keybox does not match")
+	}
+	if expected := 4 + kbxMinBlobLength*2; blocks[0].offset != expected {
+		t.Errorf("keyblock offset is %d, expecting %d", blocks[0].offset, expected)
+	}
+}
+
+func TestReadTruncatedKeybox(t *testing.T) {
+	kbx := &bytes.Buffer{}
+	writeTestBlob(kbx, kbxBlobOpenPGP, 0, []byte{1, 2, 3})
+	r := &loadReport{}
+	readKeybox("pubring.kbx", kbx.Bytes()[:10], r)
+	if len(r.diagnostics) != 1 {
+		t.Errorf("reading truncated keybox reported %d problems, expecting 1", len(r.diagnostics))
+	}
+}
+
+// writeTestBlob writes a minimal keybox blob with the keyblock directly
+// following the fixed part of the header.
+func writeTestBlob(w *bytes.Buffer, blobType byte, flags uint16, keyblock []byte) {
+	hdr := make([]byte, kbxMinBlobLength)
+	binary.BigEndian.PutUint32(hdr, uint32(len(hdr)+len(keyblock)))
+	hdr[4] = blobType
+	hdr[5] = 1
+	binary.BigEndian.PutUint16(hdr[6:], flags)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(hdr)))
+	binary.BigEndian.PutUint32(hdr[12:], uint32(len(keyblock)))
+	w.Write(hdr)
+	w.Write(keyblock)
+}
@@ -2,6 +2,7 @@ package keymgr
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -22,124 +23,450 @@ const secretKeyArmorHeader = "PGP PRIVATE KEY BLOCK"
 
 const publicKeyringFilename = "nymskeys.pub"
 const secretKeyringFilename = "nymskeys.sec"
+const lockFilename = "nymskeys.lock"
 
 var logger = gl.MustGetLogger("keymgr")
 
 var nymsDirectory = ""
 
-var defaultKeys pgpmail.KeySource
-
+var defaultKeys = newKeyStore()
+
+var errKeyExists = errors.New("key already exists in nyms keyring")
+var errKeyNotFound = errors.New("key not found")
+var errGnupgKey = errors.New("key is stored in the GnuPG keyring")
+var errSecretKeyExists = errors.New("secret key must be deleted first")
+var errNotConfirmed = errors.New("deleting a secret key must be confirmed")
+
+// keyStore holds the keys from the nyms keyrings and the GnuPG keyrings
+// and the merged view of both which is used for lookups. Changes to a key
+// are made by replacing its entity so that callers holding an entity are
+// not affected. The only exception is secret key material: UnlockPrivateKey
+// decrypts the private keys of a stored entity in place under the write
+// lock, and carryUnlockedKeys copies decrypted keys into the entities of a
+// reloaded keyring before they are stored.
 type keyStore struct {
-	publicKeys openpgp.EntityList
-	secretKeys openpgp.EntityList
+	lock        sync.RWMutex
+	nyms        keyring
+	gnupg       keyring
+	publicKeys  openpgp.EntityList
+	secretKeys  openpgp.EntityList
+	publicIndex *keyIndex
+	secretIndex *keyIndex
+	// matchSubaddresses is passed on to the indexes
+	matchSubaddresses bool
 }
 
-func init() {
-	LoadDefaultKeyring()
-	defaultKeys = &keyStore{publicKeys: publicEntities, secretKeys: secretEntities}
+// keyring is the pair of public and secret keys read from one source,
+// along with the extras of its entities and the problems found while
+// reading them.
+type keyring struct {
+	public      openpgp.EntityList
+	secret      openpgp.EntityList
+	extras      map[*openpgp.Entity]*keyExtras
+	diagnostics []KeyDiagnostic
+}
+
+func newKeyStore() *keyStore {
+	store := &keyStore{}
+	store.rebuild()
+	return store
 }
 
 func KeySource() pgpmail.KeySource {
 	return defaultKeys
 }
 
-// GetPublicKey returns the best public key for the e-mail address
-// specified or nil if no key is available
+// GetPublicKey returns the best public key to encrypt to for the e-mail
+// address specified or nil if no key is usable, see UnusableKeys.
 func (store *keyStore) GetPublicKey(address string) (*openpgp.Entity, error) {
-	el := store.lookupPublicKey(address)
-	if len(el) > 0 {
-		return el[0], nil
-	}
-	return nil, nil
+	k, _ := store.selectKey(address, false, purposeEncrypt)
+	return k, nil
 }
 
+// GetAllPublicKeys returns copies of all public keys for the e-mail
+// address specified.
 func (store *keyStore) GetAllPublicKeys(address string) (openpgp.EntityList, error) {
-	return store.lookupPublicKey(address), nil
+	return copyEntities(store.lookupPublicKey(address)), nil
 }
 
-// GetSecret returns the best secret key for the e-mail address
-// specified or nil if no key is available
+// GetSecret returns the best secret key to sign with for the e-mail
+// address specified or nil if no key is usable, see UnusableKeys.
 func (store *keyStore) GetSecretKey(address string) (*openpgp.Entity, error) {
-	el := store.lookupSecretKey(address)
-	if len(el) > 0 {
-		return el[0], nil
-	}
-	return nil, nil
+	k, _ := store.selectKey(address, true, purposeSign)
+	return k, nil
 }
 
+// GetAllSecretKeys returns copies of all secret keys for the e-mail
+// address specified.
 func (store *keyStore) GetAllSecretKeys(address string) (openpgp.EntityList, error) {
-	return store.lookupSecretKey(address), nil
+	return copyEntities(store.lookupSecretKey(address)), nil
 }
 
 func (store *keyStore) GetSecretKeyById(keyid uint64) *openpgp.Entity {
-	ks := store.secretKeys.KeysById(keyid)
-	if len(ks) > 0 {
-		return ks[0].Entity
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	if el := store.secretIndex.lookupKeyId(keyid); len(el) > 0 {
+		return el[0]
 	}
 	return nil
 }
 
 func (store *keyStore) GetPublicKeyById(keyid uint64) *openpgp.Entity {
-	ks := store.publicKeys.KeysById(keyid)
-	if len(ks) > 0 {
-		return ks[0].Entity
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	if el := store.publicIndex.lookupKeyId(keyid); len(el) > 0 {
+		return el[0]
 	}
 	return nil
 }
 
 // GetPublicKeyRing returns a list of all known public keys
 func (store *keyStore) GetPublicKeyRing() openpgp.EntityList {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
 	return store.publicKeys
 }
 
 // GetSecretKeyRing returns a list of all known private keys
 func (store *keyStore) GetSecretKeyRing() openpgp.EntityList {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
 	return store.secretKeys
 }
 
-func (store *keyStore) lookupPublicKey(email string) openpgp.EntityList {
-	return lookupByEmail(email, store.publicKeys)
+// setKeyrings replaces the contents of the store. Readers see either the
+// previous or the new keys, never a mix of both.
+func (store *keyStore) setKeyrings(nyms, gnupg keyring) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	carryUnlockedKeys(store.secretKeys, nyms.secret)
+	carryUnlockedKeys(store.secretKeys, gnupg.secret)
+	store.nyms = nyms
+	store.gnupg = gnupg
+	store.rebuild()
 }
 
-func (store *keyStore) lookupSecretKey(email string) openpgp.EntityList {
-	return lookupByEmail(email, store.secretKeys)
+// rebuild recomputes the merged view and its indexes, the write lock
+// must be held.
+func (store *keyStore) rebuild() {
+	store.publicKeys = mergeKeyrings(store.nyms.public, store.gnupg.public)
+	store.secretKeys = mergeKeyrings(store.nyms.secret, store.gnupg.secret)
+	store.publicIndex = newKeyIndex(store.publicKeys)
+	store.secretIndex = newKeyIndex(store.secretKeys)
+	store.publicIndex.matchSubaddresses = store.matchSubaddresses
+	store.secretIndex.matchSubaddresses = store.matchSubaddresses
 }
 
-func lookupByEmail(email string, keys openpgp.EntityList) openpgp.EntityList {
-	result := []*openpgp.Entity{}
-	if keys == nil {
-		return result
+// refresh updates the merged view and the indexes after the key with
+// fingerprint fp changed in one of the keyrings, the write lock must be
+// held.
+func (store *keyStore) refresh(fp [20]byte) {
+	store.publicKeys = refreshMerged(store.publicKeys, store.publicIndex, fp, store.nyms.public, store.gnupg.public)
+	store.secretKeys = refreshMerged(store.secretKeys, store.secretIndex, fp, store.nyms.secret, store.gnupg.secret)
+}
+
+// refreshMerged returns a copy of merged in which the entity for fp is the
+// one from the first of sources containing it, and updates idx to match.
+func refreshMerged(merged openpgp.EntityList, idx *keyIndex, fp [20]byte, sources ...openpgp.EntityList) openpgp.EntityList {
+	var current *openpgp.Entity
+	for _, el := range sources {
+		if current = findEntity(el, fp); current != nil {
+			break
+		}
+	}
+	old := idx.lookupFingerprint(fp)
+	if old == current {
+		return merged
 	}
-	for _, e := range keys {
-		if entityMatchesEmail(email, e) {
+	if old != nil {
+		idx.remove(old)
+	}
+	result := make(openpgp.EntityList, 0, len(merged)+1)
+	for _, e := range merged {
+		if e.PrimaryKey.Fingerprint != fp {
 			result = append(result, e)
+		} else if current != nil {
+			result = append(result, current)
+			idx.add(current)
+			current = nil
 		}
 	}
+	if current != nil {
+		result = append(result, current)
+		idx.add(current)
+	}
 	return result
 }
 
-func entityMatchesEmail(email string, e *openpgp.Entity) bool {
-	for _, v := range e.Identities {
-		if v.UserId.Email == email {
-			return true
+// AddPublicKey adds e to the nyms public keyring.
+func AddPublicKey(e *openpgp.Entity) error {
+	return defaultKeys.update(func(store *keyStore) error {
+		return store.add(publicEntity(e), store.extras(e).public(), false)
+	})
+}
+
+// AddSecretKey adds e to the nyms secret keyring and its public part to
+// the nyms public keyring unless it is already present.
+func AddSecretKey(e *openpgp.Entity) error {
+	return defaultKeys.update(func(store *keyStore) error {
+		return store.addSecretKey(e, store.extras(e))
+	})
+}
+
+// addSecretKey is like AddSecretKey with the extras x of e, the write lock
+// must be held.
+func (store *keyStore) addSecretKey(e *openpgp.Entity, x *keyExtras) error {
+	if err := store.add(e, x, true); err != nil {
+		return err
+	}
+	if findEntity(store.nyms.public, e.PrimaryKey.Fingerprint) != nil {
+		return nil
+	}
+	return store.add(publicEntity(e), x.public(), false)
+}
+
+// ReplacePublicKey stores e in the nyms public keyring in place of the
+// key with the same fingerprint, or adds it if there is none.
+func ReplacePublicKey(e *openpgp.Entity) error {
+	return defaultKeys.update(func(store *keyStore) error {
+		return store.replace(publicEntity(e), store.extras(e).public(), false)
+	})
+}
+
+// ReplaceSecretKey stores e in the nyms secret keyring in place of the
+// key with the same fingerprint, or adds it if there is none.
+func ReplaceSecretKey(e *openpgp.Entity) error {
+	return defaultKeys.update(func(store *keyStore) error {
+		return store.replace(e, store.extras(e), true)
+	})
+}
+
+// RemovePublicKey removes the key with the given fingerprint from the
+// nyms public keyring.
+func RemovePublicKey(fingerprint [20]byte) error {
+	return defaultKeys.update(func(store *keyStore) error {
+		return store.remove(fingerprint, false)
+	})
+}
+
+// RemoveSecretKey removes the key with the given fingerprint from the
+// nyms secret keyring.
+func RemoveSecretKey(fingerprint [20]byte) error {
+	return defaultKeys.update(func(store *keyStore) error {
+		return store.remove(fingerprint, true)
+	})
+}
+
+// DeleteKey removes the public key with the given fingerprint from the
+// nyms keyring. It fails while the nyms secret keyring holds the secret
+// key.
+func DeleteKey(fingerprint [20]byte) error {
+	return defaultKeys.update(func(store *keyStore) error {
+		if findEntity(store.nyms.secret, fingerprint) != nil {
+			return errSecretKeyExists
 		}
+		return store.remove(fingerprint, false)
+	})
+}
+
+// DeleteSecretKey removes the secret key with the given fingerprint from
+// the nyms keyring, keeping the public key. Since the secret key material
+// cannot be recovered, confirmed must be set.
+func DeleteSecretKey(fingerprint [20]byte, confirmed bool) error {
+	if !confirmed {
+		return errNotConfirmed
 	}
-	return false
+	return defaultKeys.update(func(store *keyStore) error {
+		return store.remove(fingerprint, true)
+	})
+}
+
+// changeKey changes the key with the given fingerprint, which must be in
+// the nyms secret keyring, in both nyms keyrings. sign is called with the
+// secret key, its extras and its primary key unlocked, using passphrase if
+// it is locked, and returns a function making the signed change to a copy
+// of the key and of its extras. The changed secret key is returned.
+func changeKey(fingerprint [20]byte, passphrase []byte, sign func(*openpgp.Entity, *keyExtras, *packet.PrivateKey) (func(*openpgp.Entity, *keyExtras), error)) (*openpgp.Entity, error) {
+	var changed *openpgp.Entity
+	err := defaultKeys.update(func(store *keyStore) error {
+		sec := findEntity(store.nyms.secret, fingerprint)
+		if sec == nil {
+			if findEntity(store.gnupg.secret, fingerprint) != nil {
+				return errGnupgKey
+			}
+			return errKeyNotFound
+		}
+		x := store.nyms.extras[sec]
+		signer, err := signingKey(sec, x, passphrase)
+		if err != nil {
+			return err
+		}
+		apply, err := sign(sec, x, signer)
+		if err != nil {
+			return err
+		}
+		pub := findEntity(store.nyms.public, fingerprint)
+		px := store.nyms.extras[pub]
+		if pub == nil {
+			pub, px = publicEntity(sec), x.public()
+		}
+		sec, pub = copyEntity(sec), copyEntity(pub)
+		x, px = x.clone(), px.clone()
+		apply(sec, x)
+		apply(pub, px)
+		if err := store.replace(sec, x, true); err != nil {
+			return err
+		}
+		if err := store.replace(pub, px, false); err != nil {
+			return err
+		}
+		changed = sec
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// signingKey returns the primary key of e unlocked, using passphrase if
+// it is locked. x are the extras of e.
+func signingKey(e *openpgp.Entity, x *keyExtras, passphrase []byte) (*packet.PrivateKey, error) {
+	if !e.PrivateKey.Encrypted {
+		return e.PrivateKey, nil
+	}
+	return unlockedKey(e.PrivateKey, x, passphrase)
+}
+
+// update runs fn with the write lock held, so that keyring files and
+// memory change together.
+func (store *keyStore) update(fn func(*keyStore) error) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return fn(store)
+}
+
+func (store *keyStore) nymsList(secret bool) *openpgp.EntityList {
+	if secret {
+		return &store.nyms.secret
+	}
+	return &store.nyms.public
+}
+
+// add stores e with its extras x in one of the nyms keyrings.
+func (store *keyStore) add(e *openpgp.Entity, x *keyExtras, secret bool) error {
+	el := store.nymsList(secret)
+	if findEntity(*el, e.PrimaryKey.Fingerprint) != nil {
+		return errKeyExists
+	}
+	if err := rewriteKeyringFile(keyringFilename(secret), e.PrimaryKey.Fingerprint, e, x, secret); err != nil {
+		return err
+	}
+	*el = append(*el, e)
+	store.nyms.setExtras(nil, e, x)
+	store.refresh(e.PrimaryKey.Fingerprint)
+	return nil
+}
+
+// replace stores e with its extras x in one of the nyms keyrings in place
+// of the key with the same fingerprint.
+func (store *keyStore) replace(e *openpgp.Entity, x *keyExtras, secret bool) error {
+	fp := e.PrimaryKey.Fingerprint
+	if err := rewriteKeyringFile(keyringFilename(secret), fp, e, x, secret); err != nil {
+		return err
+	}
+	el := store.nymsList(secret)
+	store.nyms.setExtras(findEntity(*el, fp), e, x)
+	*el = append(removeEntity(*el, fp), e)
+	store.refresh(fp)
+	return nil
+}
+
+func (store *keyStore) remove(fp [20]byte, secret bool) error {
+	el := store.nymsList(secret)
+	if findEntity(*el, fp) == nil {
+		gnupg := store.gnupg.public
+		if secret {
+			gnupg = store.gnupg.secret
+		}
+		if findEntity(gnupg, fp) != nil {
+			return errGnupgKey
+		}
+		return errKeyNotFound
+	}
+	if err := rewriteKeyringFile(keyringFilename(secret), fp, nil, nil, secret); err != nil {
+		return err
+	}
+	store.nyms.setExtras(findEntity(*el, fp), nil, nil)
+	*el = removeEntity(*el, fp)
+	store.refresh(fp)
+	return nil
+}
+
+func findEntity(el openpgp.EntityList, fp [20]byte) *openpgp.Entity {
+	for _, e := range el {
+		if e.PrimaryKey.Fingerprint == fp {
+			return e
+		}
+	}
+	return nil
+}
+
+// removeEntity returns a new list without the entity with fingerprint fp.
+func removeEntity(el openpgp.EntityList, fp [20]byte) openpgp.EntityList {
+	result := make(openpgp.EntityList, 0, len(el))
+	for _, e := range el {
+		if e.PrimaryKey.Fingerprint != fp {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// publicEntity returns a copy of e without any secret key material.
+func publicEntity(e *openpgp.Entity) *openpgp.Entity {
+	if e.PrivateKey == nil {
+		return e
+	}
+	pe := &openpgp.Entity{
+		PrimaryKey:  e.PrimaryKey,
+		Identities:  e.Identities,
+		Revocations: e.Revocations,
+	}
+	for _, sk := range e.Subkeys {
+		sk.PrivateKey = nil
+		pe.Subkeys = append(pe.Subkeys, sk)
+	}
+	return pe
+}
+
+func (store *keyStore) lookupPublicKey(email string) openpgp.EntityList {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.publicIndex.lookupEmail(email)
+}
+
+func (store *keyStore) lookupSecretKey(email string) openpgp.EntityList {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.secretIndex.lookupEmail(email)
 }
 
 func GenerateNewKey(name, comment, email string) (*openpgp.Entity, error) {
-	return generateNewKey(name, comment, email, nil)
+	return GenerateKey(name, comment, email, nil)
 }
 
 func ArmorPublicKey(e *openpgp.Entity) (string, error) {
+	x := defaultKeys.lookupExtras(e)
 	return exportArmoredKey(e, publicKeyArmorHeader, func(w io.Writer) error {
-		return e.Serialize(w)
+		return serializeEntity(w, e, x, false)
 	})
 }
 
 func ArmorSecretKey(e *openpgp.Entity) (string, error) {
+	x := defaultKeys.lookupExtras(e)
 	return exportArmoredKey(e, secretKeyArmorHeader, func(w io.Writer) error {
-		return e.SerializePrivate(w, nil)
+		return serializeEntity(w, e, x, true)
 	})
 }
 
@@ -157,44 +484,30 @@ func exportArmoredKey(e *openpgp.Entity, header string, writeKey func(io.Writer)
 	return b.String(), nil
 }
 
-func generateNewKey(name, comment, email string, config *packet.Config) (*openpgp.Entity, error) {
-	e, err := openpgp.NewEntity(name, comment, email, config)
+func generateNewKey(name, comment, email string, params *KeyParams, config *packet.Config) (*openpgp.Entity, error) {
+	e, err := newEntity(name, comment, email, params, config)
 	if err != nil {
 		return nil, err
 	}
-	addSecretKey(e)
-	return e, nil
-}
-
-func addSecretKey(e *openpgp.Entity) error {
-	return serializeKey(e, secretKeyringFilename, func(w io.Writer) error {
-		return e.SerializePrivate(w, nil)
-	})
-}
-
-func AddPublicKey(e *openpgp.Entity) error {
-	return serializeKey(e, publicKeyringFilename, func(w io.Writer) error {
-		return e.Serialize(w)
+	if err := storeRevocationCertificate(e, config); err != nil {
+		return nil, err
+	}
+	var x *keyExtras
+	if params != nil && len(params.Passphrase) > 0 {
+		if e, x, err = protectEntity(e, nil, params.Passphrase, config.Random()); err != nil {
+			return nil, err
+		}
+	}
+	err = defaultKeys.update(func(store *keyStore) error {
+		return store.addSecretKey(e, x)
 	})
-}
-
-func serializeKey(e *openpgp.Entity, fname string, writeKey func(io.Writer) error) error {
-	lock := &sync.Mutex{}
-	lock.Lock()
-	defer lock.Unlock()
-
-	path := filepath.Join(nymsDirectory, fname)
-	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
-
-	f, err := os.OpenFile(path, flags, 0666)
 	if err != nil {
-		return err
-	}
-	defer f.Close()
-	if err := writeKey(f); err != nil {
-		return err
+		if err != errKeyExists {
+			os.Remove(revocationPath(e.PrimaryKey.Fingerprint))
+		}
+		return nil, err
 	}
-	return nil
+	return e, nil
 }
 
 func nymsPath(fname string) string {
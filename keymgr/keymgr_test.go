@@ -2,12 +2,16 @@ package keymgr
 
 import (
 	"encoding/hex"
+	"sync"
 
 	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
 )
 
 func TestGenerateKey(t *testing.T) {
-	e, err := generateNewKey("foo", "", "foo@bar.com", openpgpTestConfig())
+	defer useTempNymsDirectory(t)()
+	e, err := generateNewKey("foo", "", "foo@bar.com", nil, openpgpTestConfig())
 	if err != nil {
 		t.Errorf("error generating key %v", err)
 	}
@@ -17,3 +21,134 @@ func TestGenerateKey(t *testing.T) {
 		t.Error("Generated key does not have expected fingerprint")
 	}
 }
+
+func TestGeneratedKeyIsVisible(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	e, err := generateNewKey("foo", "", "foo@bar.com", nil, openpgpTestConfig())
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	if k, _ := KeySource().GetSecretKey("foo@bar.com"); k != e {
+		t.Error("generated key not returned by GetSecretKey")
+	}
+	if k, _ := KeySource().GetPublicKey("foo@bar.com"); k == nil || k.PrivateKey != nil {
+		t.Error("public part of generated key not returned by GetPublicKey")
+	}
+
+	nyms, _, err := loadKeyrings()
+	if err != nil {
+		t.Fatalf("error loading keyrings: %v", err)
+	}
+	if len(nyms.public) != 1 || len(nyms.secret) != 1 {
+		t.Fatalf("expecting generated key in both nyms keyrings, got %d public and %d secret", len(nyms.public), len(nyms.secret))
+	}
+	if nyms.secret[0].PrimaryKey.Fingerprint != e.PrimaryKey.Fingerprint {
+		t.Error("secret key read from disk does not match generated key")
+	}
+}
+
+func TestReplaceAndRemoveKeys(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	user1 := toEntity(testDataMap["user1"].pubkey)
+	user2 := toEntity(testDataMap["user2"].pubkey)
+	fp := user1.PrimaryKey.Fingerprint
+	for _, e := range []*openpgp.Entity{user1, user2} {
+		if err := AddPublicKey(e); err != nil {
+			t.Fatalf("error adding key: %v", err)
+		}
+	}
+	if err := AddPublicKey(user1); err != errKeyExists {
+		t.Errorf("adding key twice returned %v", err)
+	}
+
+	replacement := toEntity(testDataMap["user1"].pubkey)
+	if err := ReplacePublicKey(replacement); err != nil {
+		t.Fatalf("error replacing key: %v", err)
+	}
+	if k := KeySource().GetPublicKeyById(user1.PrimaryKey.KeyId); k != replacement {
+		t.Error("replaced key not returned by GetPublicKeyById")
+	}
+	if len(KeySource().GetPublicKeyRing()) != 2 {
+		t.Errorf("expecting 2 keys after replace, got %d", len(KeySource().GetPublicKeyRing()))
+	}
+
+	if err := RemovePublicKey(fp); err != nil {
+		t.Fatalf("error removing key: %v", err)
+	}
+	if err := RemovePublicKey(fp); err != errKeyNotFound {
+		t.Errorf("removing missing key returned %v", err)
+	}
+	if k := KeySource().GetPublicKeyById(user1.PrimaryKey.KeyId); k != nil {
+		t.Error("removed key still returned by GetPublicKeyById")
+	}
+	nyms, _, _ := loadKeyrings()
+	if len(nyms.public) != 1 || nyms.public[0].PrimaryKey.Fingerprint != user2.PrimaryKey.Fingerprint {
+		t.Error("keyring file does not contain the expected key after removal")
+	}
+}
+
+func TestDeleteKeys(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	params := &KeyParams{Bits: 1024, Passphrase: []byte("password")}
+	e, err := generateNewKey("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+
+	if err := DeleteKey(fp); err != errSecretKeyExists {
+		t.Errorf("deleting public key with secret key present returned %v", err)
+	}
+	if err := DeleteSecretKey(fp, false); err != errNotConfirmed {
+		t.Errorf("unconfirmed secret key deletion returned %v", err)
+	}
+	if k, _ := KeySource().GetSecretKey("foo@bar.com"); k == nil {
+		t.Fatal("secret key removed without confirmation")
+	}
+
+	if err := DeleteSecretKey(fp, true); err != nil {
+		t.Fatalf("error deleting secret key: %v", err)
+	}
+	if k, _ := KeySource().GetSecretKey("foo@bar.com"); k != nil {
+		t.Error("deleted secret key still returned by GetSecretKey")
+	}
+	for _, x := range defaultKeys.nyms.extras {
+		if x.protectedPacket(fp) != nil {
+			t.Error("protected packet of deleted key is still stored")
+		}
+	}
+	if err := DeleteKey(fp); err != nil {
+		t.Fatalf("error deleting public key: %v", err)
+	}
+	if err := DeleteKey(fp); err != errKeyNotFound {
+		t.Errorf("deleting missing key returned %v", err)
+	}
+	nyms, _, _ := loadKeyrings()
+	if len(nyms.public) != 0 || len(nyms.secret) != 0 {
+		t.Errorf("keyring files still contain %d public and %d secret keys", len(nyms.public), len(nyms.secret))
+	}
+}
+
+func TestConcurrentKeyStoreAccess(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	var wg sync.WaitGroup
+	for _, v := range testDataMap {
+		e := toEntity(v.pubkey)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := AddPublicKey(e); err != nil {
+				t.Errorf("error adding key: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			KeySource().GetAllPublicKeys("user1@example.com")
+			KeySource().GetPublicKeyRing()
+		}()
+	}
+	wg.Wait()
+	if n := len(KeySource().GetPublicKeyRing()); n != len(testDataMap) {
+		t.Errorf("expecting %d keys after concurrent adds, got %d", len(testDataMap), n)
+	}
+}
@@ -0,0 +1,203 @@
+package keymgr
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// LoadDefaultKeyring loads the nyms keyrings from ~/.nyms and the GnuPG
+// keyrings of the current user into the default key store. Keys from the
+// nyms keyrings take precedence over GnuPG keys with the same fingerprint.
+func LoadDefaultKeyring() error {
+	nyms, gnupg, err := loadKeyrings()
+	defaultKeys.setKeyrings(nyms, gnupg)
+	return err
+}
+
+// reloadDefaultKeyring is like LoadDefaultKeyring but leaves the default
+// key store unchanged if any keyring fails to load.
+func reloadDefaultKeyring() error {
+	nyms, gnupg, err := loadKeyrings()
+	if err != nil {
+		return err
+	}
+	defaultKeys.setKeyrings(nyms, gnupg)
+	return nil
+}
+
+func loadKeyrings() (nyms, gnupg keyring, err error) {
+	nymsReport, gpgReport := &loadReport{}, &loadReport{}
+	nymsPub, nymsSec, err := loadNymsKeyrings(nymsReport)
+	if err != nil {
+		logger.Warningf("Error loading nyms keyrings: %v", err)
+	}
+	gpgPub, gpgSec, gpgErr := loadGnupgKeyrings(gpgReport)
+	if gpgErr != nil {
+		logger.Warningf("Error loading GnuPG keyrings: %v", gpgErr)
+		if err == nil {
+			err = gpgErr
+		}
+	}
+	nyms = keyring{nymsPub, nymsSec, nymsReport.extras, nymsReport.diagnostics}
+	gnupg = keyring{gpgPub, gpgSec, gpgReport.extras, gpgReport.diagnostics}
+	return nyms, gnupg, err
+}
+
+func loadNymsKeyrings(r *loadReport) (pub, sec openpgp.EntityList, err error) {
+	pub, err = loadOptionalKeyringFile(nymsPath(publicKeyringFilename), r)
+	if err != nil {
+		return nil, nil, err
+	}
+	sec, err = loadOptionalKeyringFile(nymsPath(secretKeyringFilename), r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pub, sec, nil
+}
+
+func keyringFilename(secret bool) string {
+	if secret {
+		return secretKeyringFilename
+	}
+	return publicKeyringFilename
+}
+
+func keyringFileMode(secret bool) os.FileMode {
+	if secret {
+		return 0600
+	}
+	return 0644
+}
+
+// rewriteKeyringFile rewrites one of the nyms keyring files without the
+// key with fingerprint fp, storing e with its extras x in its place or at
+// the end if e is not nil. Keys which are not affected are copied without being parsed.
+// The file is read while holding the nyms lock file, so keys written by
+// other processes sharing the directory are kept.
+func rewriteKeyringFile(fname string, fp [20]byte, e *openpgp.Entity, x *keyExtras, secret bool) error {
+	unlock, err := lockFile(nymsPath(lockFilename))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	path := nymsPath(fname)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	blocks, err := splitKeyBlocks(data)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", path, err)
+	}
+	b := &bytes.Buffer{}
+	for _, kb := range blocks {
+		if kb.fingerprint != fp {
+			b.Write(kb.data)
+		} else if e != nil {
+			if err := serializeEntity(b, e, x, secret); err != nil {
+				return err
+			}
+			e = nil
+		}
+	}
+	if e != nil {
+		if err := serializeEntity(b, e, x, secret); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path, b.Bytes(), keyringFileMode(secret))
+}
+
+// writeFileAtomic replaces the file at path by writing data to a
+// temporary file in the same directory, syncing it and renaming it. The
+// write is recorded in ownWrites so that it does not cause a reload.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	ownWrites.record(path)
+	return syncDirectory(dir)
+}
+
+// mergeKeyrings combines the given keyrings into a single list containing
+// each entity only once. When the same fingerprint appears more than once
+// the first occurrence is kept, so keyrings should be passed in order of
+// precedence.
+func mergeKeyrings(keyrings ...openpgp.EntityList) openpgp.EntityList {
+	result := openpgp.EntityList{}
+	seen := make(map[[20]byte]bool)
+	for _, el := range keyrings {
+		for _, e := range el {
+			fp := e.PrimaryKey.Fingerprint
+			if seen[fp] {
+				continue
+			}
+			seen[fp] = true
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// carryUnlockedKeys copies the key material of secret keys which have been
+// unlocked in old into the matching locked keys of a freshly loaded list
+// so that reloading a keyring does not lock keys again.
+func carryUnlockedKeys(old, loaded openpgp.EntityList) {
+	unlocked := make(map[[20]byte]*packet.PrivateKey)
+	for _, e := range old {
+		addUnlocked(unlocked, e.PrivateKey)
+		for _, sk := range e.Subkeys {
+			addUnlocked(unlocked, sk.PrivateKey)
+		}
+	}
+	if len(unlocked) == 0 {
+		return
+	}
+	for _, e := range loaded {
+		copyUnlocked(unlocked, e.PrivateKey)
+		for _, sk := range e.Subkeys {
+			copyUnlocked(unlocked, sk.PrivateKey)
+		}
+	}
+}
+
+func addUnlocked(m map[[20]byte]*packet.PrivateKey, k *packet.PrivateKey) {
+	if k != nil && !k.Encrypted && k.PrivateKey != nil {
+		m[k.Fingerprint] = k
+	}
+}
+
+func copyUnlocked(m map[[20]byte]*packet.PrivateKey, k *packet.PrivateKey) {
+	if k == nil || !k.Encrypted {
+		return
+	}
+	if u, ok := m[k.Fingerprint]; ok {
+		k.PrivateKey = u.PrivateKey
+		k.Encrypted = false
+	}
+}
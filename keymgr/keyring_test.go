@@ -0,0 +1,88 @@
+package keymgr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
+)
+
+func TestMergeKeyrings(t *testing.T) {
+	nyms := openpgp.EntityList{toEntity(testDataMap["user1"].pubkey)}
+	gpg := openpgp.EntityList{
+		toEntity(testDataMap["user1"].pubkey),
+		toEntity(testDataMap["user2"].pubkey),
+	}
+	el := mergeKeyrings(nyms, gpg)
+	if len(el) != 2 {
+		t.Fatalf("expecting 2 entities after merge, got %d", len(el))
+	}
+	if el[0] != nyms[0] {
+		t.Error("entity from first keyring did not take precedence")
+	}
+	if el[1] != gpg[1] {
+		t.Error("entity only present in second keyring was not kept")
+	}
+}
+
+func TestCarryUnlockedKeys(t *testing.T) {
+	old := toEntity(testDataMap["user4"].seckey)
+	if ok, _ := UnlockPrivateKey(old, []byte("password")); !ok {
+		t.Fatal("Unlocking private key failed")
+	}
+	loaded := toEntity(testDataMap["user4"].seckey)
+	carryUnlockedKeys(openpgp.EntityList{old}, openpgp.EntityList{loaded})
+	if loaded.PrivateKey.Encrypted {
+		t.Error("unlocked primary key was not carried over to reloaded keyring")
+	}
+	for _, sk := range loaded.Subkeys {
+		if sk.PrivateKey != nil && sk.PrivateKey.Encrypted {
+			t.Error("unlocked subkey was not carried over to reloaded keyring")
+		}
+	}
+}
+
+func TestWriteKeepsKeysFromOtherWriters(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	user1 := toEntity(testDataMap["user1"].pubkey)
+	user2 := toEntity(testDataMap["user2"].pubkey)
+	if err := AddPublicKey(user1); err != nil {
+		t.Fatalf("error adding key: %v", err)
+	}
+
+	// another process adds user2 behind the back of the key store
+	path := nymsPath(publicKeyringFilename)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.NewBuffer(data)
+	if err := user2.Serialize(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemovePublicKey(user1.PrimaryKey.Fingerprint); err != nil {
+		t.Fatalf("error removing key: %v", err)
+	}
+	if err := AddPublicKey(user2); err != nil {
+		t.Fatalf("error adding key: %v", err)
+	}
+	nyms, _, _ := loadKeyrings()
+	if len(nyms.public) != 1 || nyms.public[0].PrimaryKey.Fingerprint != user2.PrimaryKey.Fingerprint {
+		t.Errorf("expecting only the concurrently added key in keyring file, got %d keys", len(nyms.public))
+	}
+	files, _ := ioutil.ReadDir(nymsDirectory)
+	for _, fi := range files {
+		if fi.Name()[0] == '.' {
+			t.Errorf("temporary file %s left behind", fi.Name())
+		}
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("unexpected keyring file mode: %v %v", fi, err)
+	}
+}
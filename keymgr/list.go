@@ -0,0 +1,221 @@
+package keymgr
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+)
+
+// Filters for ListOptions
+const (
+	ListAll     = ""
+	ListPublic  = "public" // keys without a secret key
+	ListSecret  = "secret"
+	ListExpired = "expired"
+	ListRevoked = "revoked"
+)
+
+// Sort orders for ListOptions
+const (
+	SortByName    = "name"
+	SortByCreated = "created"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// ListOptions select the keys returned by ListKeys. Query matches a
+// substring of a user id or email address, or of the fingerprint, which
+// includes the short and long key ids. Keys are sorted by the name of
+// their primary user id unless SortBy is SortByCreated. Limit defaults to
+// 50 and is at most 500 keys.
+type ListOptions struct {
+	Query      string
+	Filter     string
+	SortBy     string
+	Descending bool
+	Offset     int
+	Limit      int
+}
+
+// KeyListing describes a key in the result of ListKeys. UserIds start with
+// the primary user id, Created and Expires are unix times and Expires is
+// zero if the key does not expire.
+type KeyListing struct {
+	Fingerprint  string
+	KeyId        string
+	UserIds      []string
+	Created      int64
+	Expires      int64
+	HasSecretKey bool
+	Expired      bool
+	Revoked      bool
+}
+
+// KeyList is one page of keys, Total is the number of keys matching the
+// query and filter.
+type KeyList struct {
+	Keys  []KeyListing
+	Total int
+}
+
+// ListKeys returns the page of known keys selected by opts.
+func ListKeys(opts ListOptions) (*KeyList, error) {
+	return defaultKeys.listKeys(opts, time.Now())
+}
+
+func (store *keyStore) listKeys(opts ListOptions, now time.Time) (*KeyList, error) {
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return nil, fmt.Errorf("invalid offset %d or limit %d", opts.Offset, opts.Limit)
+	}
+	if opts.SortBy != "" && opts.SortBy != SortByName && opts.SortBy != SortByCreated {
+		return nil, fmt.Errorf("unknown sort order %q", opts.SortBy)
+	}
+	filter, ok := listFilters[opts.Filter]
+	if !ok {
+		return nil, fmt.Errorf("unknown key filter %q", opts.Filter)
+	}
+	query := newListQuery(opts.Query)
+
+	store.lock.RLock()
+	var listings []KeyListing
+	add := func(e *openpgp.Entity) {
+		if !matchesQuery(e, query) {
+			return
+		}
+		l := newKeyListing(e, store.secretIndex.lookupFingerprint(e.PrimaryKey.Fingerprint) != nil, now)
+		if filter(&l) {
+			listings = append(listings, l)
+		}
+	}
+	for _, e := range store.publicKeys {
+		add(e)
+	}
+	for _, e := range store.secretKeys {
+		if store.publicIndex.lookupFingerprint(e.PrimaryKey.Fingerprint) == nil {
+			add(e)
+		}
+	}
+	store.lock.RUnlock()
+
+	var order sort.Interface = listingsByName(listings)
+	if opts.SortBy == SortByCreated {
+		order = listingsByCreated(listings)
+	}
+	if opts.Descending {
+		order = sort.Reverse(order)
+	}
+	sort.Sort(order)
+
+	limit := opts.Limit
+	if limit == 0 {
+		limit = defaultListLimit
+	} else if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	result := &KeyList{Total: len(listings), Keys: []KeyListing{}}
+	if opts.Offset < len(listings) {
+		end := opts.Offset + limit
+		if end > len(listings) {
+			end = len(listings)
+		}
+		result.Keys = listings[opts.Offset:end]
+	}
+	return result, nil
+}
+
+var listFilters = map[string]func(*KeyListing) bool{
+	ListAll:     func(*KeyListing) bool { return true },
+	ListPublic:  func(l *KeyListing) bool { return !l.HasSecretKey },
+	ListSecret:  func(l *KeyListing) bool { return l.HasSecretKey },
+	ListExpired: func(l *KeyListing) bool { return l.Expired },
+	ListRevoked: func(l *KeyListing) bool { return l.Revoked },
+}
+
+func newKeyListing(e *openpgp.Entity, secret bool, now time.Time) KeyListing {
+	l := KeyListing{
+		Fingerprint:  hex.EncodeToString(e.PrimaryKey.Fingerprint[:]),
+		KeyId:        fmt.Sprintf("%016x", e.PrimaryKey.KeyId),
+		Created:      e.PrimaryKey.CreationTime.Unix(),
+		HasSecretKey: secret,
+		Revoked:      isKeyRevoked(e),
+	}
+	for _, ident := range sortedIdentities(e) {
+		l.UserIds = append(l.UserIds, ident.Name)
+	}
+	if expires := KeyExpiration(e); !expires.IsZero() {
+		l.Expires = expires.Unix()
+		l.Expired = now.After(expires)
+	}
+	return l
+}
+
+// listQuery is a query folded to lower case for matching user ids, and
+// if it looks like one, the key id or fingerprint it may stand for.
+type listQuery struct {
+	text string
+	hex  string
+}
+
+// newListQuery prepares query for matching. The "0x" prefix and spaces
+// with which key ids and fingerprints are often written are removed from
+// the hexadecimal form, user ids are matched against the query as given.
+func newListQuery(query string) listQuery {
+	q := listQuery{text: strings.ToLower(strings.TrimSpace(query))}
+	if h := strings.Replace(strings.TrimPrefix(q.text, "0x"), " ", "", -1); h != "" && strings.Trim(h, "0123456789abcdef") == "" {
+		q.hex = h
+	}
+	return q
+}
+
+func matchesQuery(e *openpgp.Entity, query listQuery) bool {
+	if query.text == "" {
+		return true
+	}
+	if query.hex != "" && strings.Contains(hex.EncodeToString(e.PrimaryKey.Fingerprint[:]), query.hex) {
+		return true
+	}
+	for name, ident := range e.Identities {
+		if strings.Contains(strings.ToLower(name), query.text) ||
+			strings.Contains(normalizeEmail(userIdEmail(ident.UserId)), query.text) {
+			return true
+		}
+	}
+	return false
+}
+
+type listingsByName []KeyListing
+
+func (s listingsByName) Len() int      { return len(s) }
+func (s listingsByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s listingsByName) Less(i, j int) bool {
+	a, b := listingName(s[i]), listingName(s[j])
+	if a != b {
+		return a < b
+	}
+	return s[i].Fingerprint < s[j].Fingerprint
+}
+
+func listingName(l KeyListing) string {
+	if len(l.UserIds) == 0 {
+		return ""
+	}
+	return strings.ToLower(l.UserIds[0])
+}
+
+type listingsByCreated []KeyListing
+
+func (s listingsByCreated) Len() int      { return len(s) }
+func (s listingsByCreated) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s listingsByCreated) Less(i, j int) bool {
+	if s[i].Created != s[j].Created {
+		return s[i].Created < s[j].Created
+	}
+	return s[i].Fingerprint < s[j].Fingerprint
+}
@@ -0,0 +1,87 @@
+package keymgr
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestListKeys(t *testing.T) {
+	el := syntheticKeyring(120)
+	for i, e := range el {
+		e.PrimaryKey.CreationTime = time.Unix(int64(1000*(120-i)), 0)
+	}
+	store := &keyStore{nyms: keyring{public: el, secret: el[5:7]}}
+	store.rebuild()
+	now := time.Now()
+	first := hex.EncodeToString(el[0].PrimaryKey.Fingerprint[:])
+	fp42 := hex.EncodeToString(el[42].PrimaryKey.Fingerprint[:])
+
+	list, err := store.listKeys(ListOptions{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 120 || len(list.Keys) != defaultListLimit {
+		t.Fatalf("got %d of %d keys", len(list.Keys), list.Total)
+	}
+	if list.Keys[0].UserIds[0] != "User 0 <user0@example.com>" || list.Keys[1].UserIds[0] != "User 1 <user1@example.com>" {
+		t.Errorf("keys not sorted by name: %v", list.Keys[:2])
+	}
+
+	list, _ = store.listKeys(ListOptions{SortBy: SortByCreated, Offset: 100, Limit: 50}, now)
+	if list.Total != 120 || len(list.Keys) != 20 || list.Keys[19].Fingerprint != first {
+		t.Errorf("unexpected last page %v", list.Keys)
+	}
+	list, _ = store.listKeys(ListOptions{SortBy: SortByCreated, Descending: true, Limit: 1}, now)
+	if len(list.Keys) != 1 || list.Keys[0].Fingerprint != first {
+		t.Errorf("newest key not first: %v", list.Keys)
+	}
+	if list, _ = store.listKeys(ListOptions{Offset: 500}, now); list.Total != 120 || len(list.Keys) != 0 {
+		t.Errorf("page past the end returned %v", list.Keys)
+	}
+
+	for _, test := range []struct {
+		query string
+		count int
+	}{
+		{"USER42@", 1},
+		{"user11", 11},
+		{"0x" + fp42[32:], 1},
+		{fp42[24:], 1},
+		{"nobody", 0},
+	} {
+		if list, _ := store.listKeys(ListOptions{Query: test.query}, now); list.Total != test.count {
+			t.Errorf("query %q matched %d keys, expecting %d", test.query, list.Total, test.count)
+		}
+	}
+
+	// a name made of hex digits is still matched as a name
+	named := syntheticKeyring(1)
+	uid := packet.NewUserId("Abe Dace", "", "abe@example.com")
+	named[0].Identities = map[string]*openpgp.Identity{uid.Id: {Name: uid.Id, UserId: uid}}
+	other := &keyStore{nyms: keyring{public: named}}
+	other.rebuild()
+	if list, _ := other.listKeys(ListOptions{Query: "abe dace"}, now); list.Total != 1 {
+		t.Errorf("query for hex letter name matched %d keys", list.Total)
+	}
+
+	list, _ = store.listKeys(ListOptions{Filter: ListSecret}, now)
+	if list.Total != 2 || !list.Keys[0].HasSecretKey {
+		t.Errorf("secret filter returned %v", list.Keys)
+	}
+	if list, _ = store.listKeys(ListOptions{Filter: ListPublic}, now); list.Total != 118 {
+		t.Errorf("public filter returned %d keys", list.Total)
+	}
+	if list, _ = store.listKeys(ListOptions{Filter: ListRevoked}, now); list.Total != 0 {
+		t.Errorf("revoked filter returned %d keys", list.Total)
+	}
+	if _, err := store.listKeys(ListOptions{Filter: "bogus"}, now); err == nil {
+		t.Error("unknown filter accepted")
+	}
+	if _, err := store.listKeys(ListOptions{SortBy: "size"}, now); err == nil {
+		t.Error("unknown sort order accepted")
+	}
+}
@@ -0,0 +1,191 @@
+package keymgr
+
+import (
+	"bytes"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// copyEntity returns a copy of e which can be changed without affecting
+// e. Keys, user ids and signatures are shared since they are never
+// modified in place.
+func copyEntity(e *openpgp.Entity) *openpgp.Entity {
+	c := *e
+	c.Revocations = append([]*packet.Signature(nil), e.Revocations...)
+	c.Identities = make(map[string]*openpgp.Identity, len(e.Identities))
+	for name, ident := range e.Identities {
+		ci := *ident
+		ci.Signatures = append([]*packet.Signature(nil), ident.Signatures...)
+		c.Identities[name] = &ci
+	}
+	c.Subkeys = append([]openpgp.Subkey(nil), e.Subkeys...)
+	return &c
+}
+
+// copyEntities returns a list of copies of the entities in el.
+func copyEntities(el openpgp.EntityList) openpgp.EntityList {
+	if el == nil {
+		return nil
+	}
+	c := make(openpgp.EntityList, len(el))
+	for i, e := range el {
+		c[i] = copyEntity(e)
+	}
+	return c
+}
+
+// mergeEntity returns old with the revocations, user ids, subkeys and
+// signatures of update added which it does not already have. Newer self
+// signatures replace older ones, subkey signatures are merged by
+// mergeSubkeySig into the entity and its extras x, and secret key material
+// missing from old is taken from update. The second result reports
+// whether anything changed, old itself is never modified.
+func mergeEntity(old, update *openpgp.Entity, x *keyExtras) (*openpgp.Entity, bool) {
+	e := copyEntity(old)
+	changed := false
+	if e.PrivateKey == nil && update.PrivateKey != nil {
+		e.PrimaryKey, e.PrivateKey = update.PrimaryKey, update.PrivateKey
+		changed = true
+	}
+	for _, sig := range update.Revocations {
+		if !containsSignature(e.Revocations, sig) {
+			e.Revocations = append(e.Revocations, sig)
+			changed = true
+		}
+	}
+	for name, ident := range update.Identities {
+		ci, ok := e.Identities[name]
+		if !ok {
+			c := *ident
+			e.Identities[name] = &c
+			changed = true
+			continue
+		}
+		if ident.SelfSignature.CreationTime.After(ci.SelfSignature.CreationTime) {
+			ci.SelfSignature = ident.SelfSignature
+			changed = true
+		}
+		for _, sig := range ident.Signatures {
+			if !containsSignature(ci.Signatures, sig) {
+				ci.Signatures = append(ci.Signatures, sig)
+				changed = true
+			}
+		}
+	}
+	for _, sk := range update.Subkeys {
+		i := findSubkey(e.Subkeys, sk.PublicKey.Fingerprint)
+		if i == -1 {
+			e.Subkeys = append(e.Subkeys, sk)
+			changed = true
+			continue
+		}
+		cur := &e.Subkeys[i]
+		if e.PrimaryKey.VerifyKeySignature(cur.PublicKey, sk.Sig) == nil && mergeSubkeySig(cur, sk.Sig, x) {
+			changed = true
+		}
+		if cur.PrivateKey == nil && sk.PrivateKey != nil {
+			cur.PublicKey, cur.PrivateKey = sk.PublicKey, sk.PrivateKey
+			changed = true
+		}
+	}
+	return e, changed
+}
+
+// mergeSubkeySig merges sig, a valid signature of the subkey sk from an
+// imported key, into sk. A revocation always replaces a binding and is
+// never replaced by one, otherwise the newer signature wins. The binding
+// of a revoked subkey is kept in x to be written along with the
+// revocation. It returns true if sk or x changed.
+func mergeSubkeySig(sk *openpgp.Subkey, sig *packet.Signature, x *keyExtras) bool {
+	fp := sk.PublicKey.Fingerprint
+	revoked := sk.Sig.SigType == packet.SigTypeSubkeyRevocation
+	revokes := sig.SigType == packet.SigTypeSubkeyRevocation
+	switch {
+	case revokes && !revoked:
+		x.setBinding(fp, sk.Sig)
+		sk.Sig = sig
+	case revoked && !revokes:
+		if b := x.binding(fp); b != nil && !sig.CreationTime.After(b.CreationTime) {
+			return false
+		}
+		x.setBinding(fp, sig)
+	case sig.CreationTime.After(sk.Sig.CreationTime):
+		sk.Sig = sig
+	default:
+		return false
+	}
+	return true
+}
+
+// mergeExtras returns a copy of old with the subkey bindings, user
+// attributes and unparsed packets of update added which it does not
+// already have. The
+// protected packets of update are added for the locked secret keys of the
+// merged entity e which have none. The second result reports whether
+// anything was added.
+func mergeExtras(old, update *keyExtras, e *openpgp.Entity) (*keyExtras, bool) {
+	x := old.clone()
+	if update == nil {
+		return x, false
+	}
+	changed := false
+	if e.PrivateKey != nil {
+		for _, priv := range privateKeys(e) {
+			if !priv.Encrypted || x.protectedPacket(priv.Fingerprint) != nil {
+				continue
+			}
+			if pkt := update.protectedPacket(priv.Fingerprint); pkt != nil {
+				x.setProtected(priv.Fingerprint, pkt)
+				changed = true
+			}
+		}
+	}
+	for fp, sig := range update.bindings {
+		if x.binding(fp) == nil {
+			x.setBinding(fp, sig)
+			changed = true
+		}
+	}
+	n := countPackets(x.attributes) + countPackets(x.unparsed)
+	x.attributes = mergeSections(x.attributes, update.attributes)
+	x.unparsed = mergeSections(x.unparsed, update.unparsed)
+	if countPackets(x.attributes)+countPackets(x.unparsed) != n {
+		changed = true
+	}
+	return x, changed
+}
+
+// countPackets returns the number of packets in sections.
+func countPackets(sections []*keySection) int {
+	n := 0
+	for _, s := range sections {
+		n += 1 + len(s.packets)
+	}
+	return n
+}
+
+func findSubkey(subkeys []openpgp.Subkey, fp [20]byte) int {
+	for i, sk := range subkeys {
+		if sk.PublicKey.Fingerprint == fp {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsSignature(sigs []*packet.Signature, sig *packet.Signature) bool {
+	data := signatureBytes(sig)
+	for _, s := range sigs {
+		if bytes.Equal(signatureBytes(s), data) {
+			return true
+		}
+	}
+	return false
+}
+
+func signatureBytes(sig *packet.Signature) []byte {
+	b := &bytes.Buffer{}
+	sig.Serialize(b)
+	return b.Bytes()
+}
@@ -0,0 +1,164 @@
+package keymgr
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// ocbTagSize is the size of the authentication tag gpg-agent appends to
+// keys protected in OCB mode.
+const ocbTagSize = 16
+
+var errOCBAuthentication = errors.New("OCB authentication failed")
+
+// ocb implements decryption in the OCB mode of RFC 7253 with a 128 bit
+// tag, which gpg-agent 2.3 and later uses to protect secret keys. The
+// standard library has no OCB implementation.
+type ocb struct {
+	block   cipher.Block
+	lStar   [16]byte
+	lDollar [16]byte
+	l       [][16]byte
+}
+
+func newOCB(block cipher.Block) *ocb {
+	o := &ocb{block: block}
+	block.Encrypt(o.lStar[:], o.lStar[:])
+	o.lDollar = ocbDouble(o.lStar)
+	o.l = [][16]byte{ocbDouble(o.lDollar)}
+	return o
+}
+
+// ocbDouble returns the doubling of b in GF(2^128).
+func ocbDouble(b [16]byte) [16]byte {
+	var d [16]byte
+	for i := 0; i < 15; i++ {
+		d[i] = b[i]<<1 | b[i+1]>>7
+	}
+	d[15] = b[15] << 1
+	if b[0]&0x80 != 0 {
+		d[15] ^= 0x87
+	}
+	return d
+}
+
+// lAt returns L_i for the number of trailing zeros i of a block index.
+func (o *ocb) lAt(i int) [16]byte {
+	for len(o.l) <= i {
+		o.l = append(o.l, ocbDouble(o.l[len(o.l)-1]))
+	}
+	return o.l[i]
+}
+
+func ntz(n int) int {
+	z := 0
+	for n&1 == 0 {
+		n >>= 1
+		z++
+	}
+	return z
+}
+
+func xorBlock(dst *[16]byte, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// initialOffset returns Offset_0 for a nonce of at most 15 bytes.
+func (o *ocb) initialOffset(nonce []byte) [16]byte {
+	var n [16]byte
+	copy(n[16-len(nonce):], nonce)
+	n[15-len(nonce)] |= 1
+	bottom := uint(n[15] & 63)
+	n[15] &^= 63
+	var ktop [16]byte
+	o.block.Encrypt(ktop[:], n[:])
+	var stretch [24]byte
+	copy(stretch[:], ktop[:])
+	for i := 0; i < 8; i++ {
+		stretch[16+i] = ktop[i] ^ ktop[i+1]
+	}
+	var offset [16]byte
+	shift, bits := bottom/8, bottom%8
+	for i := range offset {
+		offset[i] = stretch[i+int(shift)] << bits
+		if bits != 0 {
+			offset[i] |= stretch[i+int(shift)+1] >> (8 - bits)
+		}
+	}
+	return offset
+}
+
+// hash returns HASH(K, A) of the associated data.
+func (o *ocb) hash(adata []byte) [16]byte {
+	var sum, offset, tmp [16]byte
+	i := 1
+	for ; len(adata) >= 16; i++ {
+		l := o.lAt(ntz(i))
+		xorBlock(&offset, l[:])
+		tmp = offset
+		xorBlock(&tmp, adata[:16])
+		o.block.Encrypt(tmp[:], tmp[:])
+		xorBlock(&sum, tmp[:])
+		adata = adata[16:]
+	}
+	if len(adata) > 0 {
+		xorBlock(&offset, o.lStar[:])
+		tmp = [16]byte{}
+		copy(tmp[:], adata)
+		tmp[len(adata)] = 0x80
+		xorBlock(&tmp, offset[:])
+		o.block.Encrypt(tmp[:], tmp[:])
+		xorBlock(&sum, tmp[:])
+	}
+	return sum
+}
+
+// open decrypts and authenticates ciphertext, which ends with the tag.
+func (o *ocb) open(nonce, ciphertext, adata []byte) ([]byte, error) {
+	if len(nonce) == 0 || len(nonce) > 15 || len(ciphertext) < ocbTagSize {
+		return nil, errOCBAuthentication
+	}
+	tag := ciphertext[len(ciphertext)-ocbTagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-ocbTagSize]
+	plaintext := make([]byte, len(ciphertext))
+
+	offset := o.initialOffset(nonce)
+	var checksum, tmp [16]byte
+	i := 1
+	for pos := 0; len(ciphertext)-pos >= 16; pos, i = pos+16, i+1 {
+		l := o.lAt(ntz(i))
+		xorBlock(&offset, l[:])
+		tmp = offset
+		xorBlock(&tmp, ciphertext[pos:pos+16])
+		o.block.Decrypt(tmp[:], tmp[:])
+		xorBlock(&tmp, offset[:])
+		copy(plaintext[pos:], tmp[:])
+		xorBlock(&checksum, tmp[:])
+	}
+	if rest := len(ciphertext) % 16; rest > 0 {
+		pos := len(ciphertext) - rest
+		xorBlock(&offset, o.lStar[:])
+		var pad [16]byte
+		o.block.Encrypt(pad[:], offset[:])
+		tmp = [16]byte{}
+		for j := 0; j < rest; j++ {
+			plaintext[pos+j] = ciphertext[pos+j] ^ pad[j]
+			tmp[j] = plaintext[pos+j]
+		}
+		tmp[rest] = 0x80
+		xorBlock(&checksum, tmp[:])
+	}
+
+	xorBlock(&checksum, offset[:])
+	xorBlock(&checksum, o.lDollar[:])
+	o.block.Encrypt(checksum[:], checksum[:])
+	h := o.hash(adata)
+	xorBlock(&checksum, h[:])
+	if subtle.ConstantTimeCompare(checksum[:], tag) != 1 {
+		return nil, errOCBAuthentication
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,169 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// OpenPGP packet tags, RFC 4880 section 4.3
+const (
+	tagSignature     = 2
+	tagSecretKey     = 5
+	tagPublicKey     = 6
+	tagSecretSubkey  = 7
+	tagUserId        = 13
+	tagPublicSubkey  = 14
+	tagUserAttribute = 17
+)
+
+// nextPacket splits the first OpenPGP packet from data and returns its
+// tag, its body and the total length of the packet including the header.
+// Partial body lengths are not supported since they are not permitted for
+// key material.
+func nextPacket(data []byte) (tag byte, body []byte, n int, err error) {
+	if len(data) < 2 {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	if data[0]&0x80 == 0 {
+		return 0, nil, 0, errors.New("invalid packet header")
+	}
+	var length, hlen int
+	if data[0]&0x40 == 0 {
+		// old format packet
+		tag = (data[0] & 0x3f) >> 2
+		switch data[0] & 3 {
+		case 0:
+			hlen, length = 2, int(data[1])
+		case 1:
+			if len(data) < 3 {
+				return 0, nil, 0, io.ErrUnexpectedEOF
+			}
+			hlen, length = 3, int(data[1])<<8|int(data[2])
+		case 2:
+			if len(data) < 5 {
+				return 0, nil, 0, io.ErrUnexpectedEOF
+			}
+			hlen, length = 5, int(data[1])<<24|int(data[2])<<16|int(data[3])<<8|int(data[4])
+		default:
+			return 0, nil, 0, errors.New("indeterminate length packets are not supported")
+		}
+	} else {
+		tag = data[0] & 0x3f
+		switch {
+		case data[1] < 192:
+			hlen, length = 2, int(data[1])
+		case data[1] < 224:
+			if len(data) < 3 {
+				return 0, nil, 0, io.ErrUnexpectedEOF
+			}
+			hlen, length = 3, (int(data[1])-192)<<8+int(data[2])+192
+		case data[1] == 255:
+			if len(data) < 6 {
+				return 0, nil, 0, io.ErrUnexpectedEOF
+			}
+			hlen, length = 6, int(data[2])<<24|int(data[3])<<16|int(data[4])<<8|int(data[5])
+		default:
+			return 0, nil, 0, errors.New("partial length packets are not supported")
+		}
+	}
+	if length < 0 || hlen+length > len(data) {
+		return 0, nil, 0, io.ErrUnexpectedEOF
+	}
+	return tag, data[hlen : hlen+length], hlen + length, nil
+}
+
+// keyBlock is the raw data of one key in a binary keyring, starting with
+// a primary key packet.
+type keyBlock struct {
+	offset      int
+	data        []byte
+	fingerprint [20]byte
+}
+
+// splitKeyBlocks splits a binary keyring into one block per key without
+// otherwise interpreting the packets. If the packet framing is damaged the
+// blocks preceding the damage are returned along with the error.
+func splitKeyBlocks(data []byte) ([]keyBlock, error) {
+	var blocks []keyBlock
+	for off := 0; off < len(data); {
+		tag, body, n, err := nextPacket(data[off:])
+		if err != nil {
+			return blocks, fmt.Errorf("offset %d: %v", off, err)
+		}
+		if tag == tagPublicKey || tag == tagSecretKey || len(blocks) == 0 {
+			blocks = append(blocks, keyBlock{
+				offset:      off,
+				fingerprint: keyPacketFingerprint(tag, body, data[off:off+n]),
+			})
+		}
+		b := &blocks[len(blocks)-1]
+		b.data = data[b.offset : off+n]
+		off += n
+	}
+	return blocks, nil
+}
+
+// keyPacketFingerprint returns the fingerprint of a key packet, or all
+// zeros if it cannot be determined.
+func keyPacketFingerprint(tag byte, body, pkt []byte) (fp [20]byte) {
+	switch tag {
+	case tagPublicKey, tagPublicSubkey:
+		h := sha1.New()
+		h.Write([]byte{0x99, byte(len(body) >> 8), byte(len(body))})
+		h.Write(body)
+		copy(fp[:], h.Sum(nil))
+	case tagSecretKey, tagSecretSubkey:
+		if pk, err := readPrivateKeyPacket(pkt); err == nil {
+			fp = pk.Fingerprint
+		}
+	}
+	return fp
+}
+
+// writePacket writes body to w as a new format packet with the given tag.
+func writePacket(w io.Writer, tag byte, body []byte) error {
+	header := []byte{0xc0 | tag}
+	n := len(body)
+	switch {
+	case n < 192:
+		header = append(header, byte(n))
+	case n < 8384:
+		n -= 192
+		header = append(header, byte(192+n>>8), byte(n))
+	default:
+		header = append(header, 255, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// publicKeyBody returns the body of the public key packet for pk.
+func publicKeyBody(pk *packet.PublicKey) ([]byte, error) {
+	b := &bytes.Buffer{}
+	if err := pk.Serialize(b); err != nil {
+		return nil, err
+	}
+	_, body, _, err := nextPacket(b.Bytes())
+	return body, err
+}
+
+// readPrivateKeyPacket parses a single secret key or secret subkey packet.
+func readPrivateKeyPacket(data []byte) (*packet.PrivateKey, error) {
+	p, err := packet.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	pk, ok := p.(*packet.PrivateKey)
+	if !ok {
+		return nil, errors.New("not a secret key packet")
+	}
+	return pk, nil
+}
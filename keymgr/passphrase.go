@@ -0,0 +1,101 @@
+package keymgr
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+var errEmptyPassphrase = errors.New("new passphrase is empty")
+
+// ChangePassphrase protects the secret key with the given fingerprint with
+// a new passphrase, after unlocking its primary key and subkeys with the
+// old one, and rewrites it in the nyms secret keyring. With an empty new
+// passphrase the key is only stored unprotected if removeProtection is
+// set. The changed key is returned.
+func ChangePassphrase(fingerprint [20]byte, oldPassphrase, newPassphrase []byte, removeProtection bool) (*openpgp.Entity, error) {
+	if len(newPassphrase) == 0 && !removeProtection {
+		return nil, errEmptyPassphrase
+	}
+	var changed *openpgp.Entity
+	err := defaultKeys.update(func(store *keyStore) error {
+		e := findEntity(store.nyms.secret, fingerprint)
+		if e == nil {
+			if findEntity(store.gnupg.secret, fingerprint) != nil {
+				return errGnupgKey
+			}
+			return errKeyNotFound
+		}
+		x := store.nyms.extras[e]
+		unlocked, err := unlockedCopy(e, x, oldPassphrase)
+		if err != nil {
+			return err
+		}
+		var cx *keyExtras
+		if len(newPassphrase) == 0 {
+			changed, cx = unlocked, x.clone()
+			cx.protected = nil
+		} else if changed, cx, err = protectEntity(unlocked, x, newPassphrase, rand.Reader); err != nil {
+			return err
+		}
+		return store.replace(changed, cx, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// unlockedCopy returns a copy of e with all secret keys unlocked with
+// passphrase. Keys which are protected according to the extras x of e are
+// unlocked from their protected packet, so the passphrase is checked even
+// if e was unlocked before.
+func unlockedCopy(e *openpgp.Entity, x *keyExtras, passphrase []byte) (*openpgp.Entity, error) {
+	priv, err := unlockedKey(e.PrivateKey, x, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	c := *e
+	c.PrimaryKey, c.PrivateKey = &priv.PublicKey, priv
+	c.Subkeys = make([]openpgp.Subkey, len(e.Subkeys))
+	for i, sk := range e.Subkeys {
+		if sk.PrivateKey != nil {
+			if sk.PrivateKey, err = unlockedKey(sk.PrivateKey, x, passphrase); err != nil {
+				return nil, err
+			}
+			sk.PublicKey = &sk.PrivateKey.PublicKey
+		}
+		c.Subkeys[i] = sk
+	}
+	return &c, nil
+}
+
+func unlockedKey(priv *packet.PrivateKey, x *keyExtras, passphrase []byte) (*packet.PrivateKey, error) {
+	if pkt := x.protectedPacket(priv.Fingerprint); pkt != nil {
+		pk, err := readPrivateKeyPacket(pkt)
+		if err != nil {
+			return nil, err
+		}
+		if err := pk.Decrypt(passphrase); err != nil {
+			return nil, errWrongPassphrase
+		}
+		return pk, nil
+	}
+	if priv.Encrypted {
+		return nil, errLockedKey
+	}
+	pk := *priv
+	return &pk, nil
+}
+
+func privateKeys(e *openpgp.Entity) []*packet.PrivateKey {
+	keys := []*packet.PrivateKey{e.PrivateKey}
+	for _, sk := range e.Subkeys {
+		if sk.PrivateKey != nil {
+			keys = append(keys, sk.PrivateKey)
+		}
+	}
+	return keys
+}
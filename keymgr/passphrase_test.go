@@ -0,0 +1,57 @@
+package keymgr
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
+)
+
+func TestChangePassphrase(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	params := &KeyParams{Bits: 1024, Passphrase: []byte("old")}
+	e, err := generateNewKey("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+
+	if _, err := ChangePassphrase(fp, []byte("wrong"), []byte("new"), false); err != errWrongPassphrase {
+		t.Errorf("expecting wrong passphrase error, got %v", err)
+	}
+	if _, err := ChangePassphrase(fp, []byte("old"), nil, false); err != errEmptyPassphrase {
+		t.Errorf("expecting empty passphrase error, got %v", err)
+	}
+	if _, err := ChangePassphrase(fp, []byte("old"), []byte("new"), false); err != nil {
+		t.Fatalf("error changing passphrase: %v", err)
+	}
+	k := storedSecretKey(t)
+	if k.PrivateKey.Decrypt([]byte("old")) == nil {
+		t.Error("stored key can still be unlocked with old passphrase")
+	}
+	for _, priv := range privateKeys(k) {
+		if err := priv.Decrypt([]byte("new")); err != nil {
+			t.Errorf("stored key cannot be unlocked with new passphrase: %v", err)
+		}
+	}
+
+	c, err := ChangePassphrase(fp, []byte("new"), nil, true)
+	if err != nil {
+		t.Fatalf("error removing passphrase: %v", err)
+	}
+	if c.PrivateKey.Encrypted || storedSecretKey(t).PrivateKey.Encrypted {
+		t.Error("key is still protected")
+	}
+}
+
+func storedSecretKey(t *testing.T) *openpgp.Entity {
+	data, err := ioutil.ReadFile(nymsPath(secretKeyringFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	el := readKeyringData("nymskeys.sec", 0, data, nil)
+	if len(el) != 1 {
+		t.Fatalf("expecting 1 stored key, got %d", len(el))
+	}
+	return el[0]
+}
@@ -0,0 +1,200 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash"
+	"image/jpeg"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// maxPhotoSize limits the size of the JPEG images of new photo ids.
+const maxPhotoSize = 64 * 1024
+
+// imageEncodingJPEG is the only image encoding of RFC 4880 section 5.12.1
+const imageEncodingJPEG = 1
+
+var errInvalidPhoto = errors.New("photo is not a JPEG image")
+var errPhotoTooLarge = fmt.Errorf("photo is larger than %d bytes", maxPhotoSize)
+var errPhotoExists = errors.New("photo id already exists")
+
+// Photo is the image of a photo id.
+type Photo struct {
+	MimeType string
+	Data     []byte
+}
+
+// userAttributeSections returns the user attribute sections of the key
+// block data.
+func userAttributeSections(data []byte) []*keySection {
+	sections, _ := splitSections(data)
+	var attrs []*keySection
+	for _, s := range sections {
+		if s.tag == tagUserAttribute {
+			attrs = append(attrs, s)
+		}
+	}
+	return attrs
+}
+
+// PrimaryPhoto returns the image of the photo id of e marked as primary,
+// or of the first photo id if none is. Only photo ids with a valid self
+// signature which is not revoked are considered. Nil is returned if e has
+// no such photo id.
+func PrimaryPhoto(e *openpgp.Entity) *Photo {
+	return primaryPhoto(e, defaultKeys.lookupExtras(e))
+}
+
+// primaryPhoto is like PrimaryPhoto with the extras x of e, which hold its
+// user attributes.
+func primaryPhoto(e *openpgp.Entity, x *keyExtras) *Photo {
+	var best *Photo
+	bestPrimary := false
+	now := time.Now()
+	for _, s := range x.userAttributes() {
+		_, body, _, err := nextPacket(s.pkt)
+		if err != nil {
+			continue
+		}
+		sig := userAttributeSelfSignature(e.PrimaryKey, body, s.packets, now)
+		if sig == nil {
+			continue
+		}
+		photo := parsePhoto(body)
+		if photo == nil {
+			continue
+		}
+		primary := sig.IsPrimaryId != nil && *sig.IsPrimaryId
+		if best == nil || (primary && !bestPrimary) {
+			best, bestPrimary = photo, primary
+		}
+	}
+	return best
+}
+
+// userAttributeSelfSignature returns the newest valid self signature of
+// the user attribute with the given packet body among packets, or nil if
+// there is none or the attribute is revoked.
+func userAttributeSelfSignature(pk *packet.PublicKey, body []byte, packets [][]byte, now time.Time) *packet.Signature {
+	var selfSig, revocation *packet.Signature
+	for _, p := range packets {
+		sig, ok := readSignaturePacket(p)
+		if !ok || sig.IssuerKeyId == nil || *sig.IssuerKeyId != pk.KeyId {
+			continue
+		}
+		isCert := sig.SigType >= packet.SigTypeGenericCert && sig.SigType <= packet.SigTypePositiveCert
+		if !isCert && sig.SigType != sigTypeCertificationRevocation {
+			continue
+		}
+		if verifyUserAttributeSignature(pk, body, sig) != nil {
+			continue
+		}
+		if !isCert {
+			revocation = sig
+		} else if !signatureExpired(sig, now) && (selfSig == nil || sig.CreationTime.After(selfSig.CreationTime)) {
+			selfSig = sig
+		}
+	}
+	if revocation != nil {
+		return nil
+	}
+	return selfSig
+}
+
+func verifyUserAttributeSignature(pk *packet.PublicKey, body []byte, sig *packet.Signature) error {
+	if !sig.Hash.Available() {
+		return fmt.Errorf("unsupported hash function %v", sig.Hash)
+	}
+	h := sig.Hash.New()
+	if err := hashKey(h, pk); err != nil {
+		return err
+	}
+	hashUserAttribute(h, body)
+	return pk.VerifySignature(h, sig)
+}
+
+// hashUserAttribute writes the user attribute prefix and body of the data
+// covered by a certification, RFC 4880 section 5.2.4.
+func hashUserAttribute(h hash.Hash, body []byte) {
+	n := len(body)
+	h.Write([]byte{0xd1, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	h.Write(body)
+}
+
+// parsePhoto returns the first JPEG image of the user attribute with the
+// given packet body.
+func parsePhoto(body []byte) *Photo {
+	sps, err := packet.OpaqueSubpackets(body)
+	if err != nil {
+		return nil
+	}
+	for _, sp := range sps {
+		c := sp.Contents
+		if sp.SubType != packet.UserAttrImageSubpacket || len(c) < 4 {
+			continue
+		}
+		// little endian header length, header version and encoding
+		n := int(c[0]) | int(c[1])<<8
+		if n < 4 || n >= len(c) || c[2] != 1 || c[3] != imageEncodingJPEG {
+			continue
+		}
+		return &Photo{MimeType: "image/jpeg", Data: c[n:]}
+	}
+	return nil
+}
+
+// photoAttributeBody returns the body of a user attribute packet holding
+// the JPEG image data.
+func photoAttributeBody(data []byte) []byte {
+	header := make([]byte, 16)
+	header[0], header[2], header[3] = 16, 1, imageEncodingJPEG
+	sp := &packet.OpaqueSubpacket{
+		SubType:  packet.UserAttrImageSubpacket,
+		Contents: append(header, data...),
+	}
+	b := &bytes.Buffer{}
+	sp.Serialize(b)
+	return b.Bytes()
+}
+
+// AddPhotoId adds a photo id with the JPEG image data to the key with the
+// given fingerprint, which must be in the nyms secret keyring, self signed
+// like AddUserId. The changed secret key is returned.
+func AddPhotoId(fingerprint [20]byte, data []byte, passphrase []byte) (*openpgp.Entity, error) {
+	if len(data) > maxPhotoSize {
+		return nil, errPhotoTooLarge
+	}
+	if _, err := jpeg.DecodeConfig(bytes.NewReader(data)); err != nil {
+		return nil, errInvalidPhoto
+	}
+	body := photoAttributeBody(data)
+	return changeKey(fingerprint, passphrase, func(e *openpgp.Entity, x *keyExtras, signer *packet.PrivateKey) (func(*openpgp.Entity, *keyExtras), error) {
+		for _, s := range x.userAttributes() {
+			if _, b, _, err := nextPacket(s.pkt); err == nil && bytes.Equal(b, body) {
+				return nil, errPhotoExists
+			}
+		}
+		template := selfSignatureTemplate(e)
+		b := newSelfSignatureBuilder(template, time.Now(), false, signatureLifetime(template))
+		sig, err := b.signUserAttribute(body, e.PrimaryKey, signer, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		section := &bytes.Buffer{}
+		if err := writePacket(section, tagUserAttribute, body); err != nil {
+			return nil, err
+		}
+		if err := sig.Serialize(section); err != nil {
+			return nil, err
+		}
+		attrs := userAttributeSections(section.Bytes())
+		return func(_ *openpgp.Entity, cx *keyExtras) {
+			cx.attributes = append(cx.attributes, attrs...)
+		}, nil
+	})
+}
@@ -0,0 +1,93 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto/rand"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func testJPEG(t *testing.T, size int) []byte {
+	b := &bytes.Buffer{}
+	if err := jpeg.Encode(b, image.NewGray(image.Rect(0, 0, size, size)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestAddPhotoId(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	params := &KeyParams{Algorithm: "ecdsa", Bits: 1024}
+	e, err := generateNewKey("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+	if PrimaryPhoto(e) != nil {
+		t.Error("new key has a photo")
+	}
+
+	photo := testJPEG(t, 16)
+	if _, err := AddPhotoId(fp, []byte("not an image"), nil); err != errInvalidPhoto {
+		t.Errorf("adding invalid photo returned %v", err)
+	}
+	if _, err := AddPhotoId(fp, make([]byte, maxPhotoSize+1), nil); err != errPhotoTooLarge {
+		t.Errorf("adding large photo returned %v", err)
+	}
+	k, err := AddPhotoId(fp, photo, nil)
+	if err != nil {
+		t.Fatalf("error adding photo id: %v", err)
+	}
+	if p := PrimaryPhoto(k); p == nil || p.MimeType != "image/jpeg" || !bytes.Equal(p.Data, photo) {
+		t.Errorf("unexpected photo %v", p)
+	}
+	if _, err := AddPhotoId(fp, photo, nil); err != errPhotoExists {
+		t.Errorf("adding photo twice returned %v", err)
+	}
+
+	// the photo id is kept when the key is written again
+	if _, err := AddUserId(fp, "bar", "", "bar@bar.com", nil); err != nil {
+		t.Fatalf("error adding user id: %v", err)
+	}
+	if err := LoadDefaultKeyring(); err != nil {
+		t.Fatal(err)
+	}
+	if p := PrimaryPhoto(KeySource().GetSecretKeyById(e.PrimaryKey.KeyId)); p == nil || !bytes.Equal(p.Data, photo) {
+		t.Error("photo id not read back from keyring")
+	}
+
+	// and imported along with the key
+	data, err := ArmorPublicKey(KeySource().GetPublicKeyById(e.PrimaryKey.KeyId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer useTempNymsDirectory(t)()
+	expectImport(t, []byte(data), ImportNew)
+	if p := PrimaryPhoto(KeySource().GetPublicKeyById(e.PrimaryKey.KeyId)); p == nil || !bytes.Equal(p.Data, photo) {
+		t.Error("photo id not imported")
+	}
+}
+
+func TestPhotoIdSignatureIsChecked(t *testing.T) {
+	config := &packet.Config{Time: time.Now}
+	e, err := newEntity("foo", "", "foo@bar.com", &KeyParams{Algorithm: "ecdsa", Bits: 1024}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := photoAttributeBody(testJPEG(t, 8))
+	b := newSelfSignatureBuilder(sortedIdentities(e)[0].SelfSignature, time.Now(), true, 0)
+	sig, err := b.signUserAttribute(signed, e.PrimaryKey, e.PrivateKey, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	section := &bytes.Buffer{}
+	writePacket(section, tagUserAttribute, photoAttributeBody(testJPEG(t, 16)))
+	sig.Serialize(section)
+	if primaryPhoto(e, &keyExtras{attributes: userAttributeSections(section.Bytes())}) != nil {
+		t.Error("photo id with a signature over another image accepted")
+	}
+}
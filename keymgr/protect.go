@@ -0,0 +1,156 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"code.google.com/p/go.crypto/openpgp/s2k"
+)
+
+// Secret keys are protected with AES-256 keyed by an iterated and salted
+// SHA-256 S2K, RFC 4880 sections 3.7.1.3 and 5.5.3.
+const (
+	s2kUsageSHA1   = 254
+	s2kIterated    = 3
+	s2kCipherAES   = 9
+	s2kHashSHA256  = 8
+	s2kCountByte   = 0xe0
+	protectIVSize  = aes.BlockSize
+	protectKeySize = 32
+)
+
+// protectedPackets returns the protected secret key packets of a key read
+// from a keyring by fingerprint, or nil if it has none.
+func protectedPackets(data []byte) map[[20]byte][]byte {
+	var protected map[[20]byte][]byte
+	for off := 0; off < len(data); {
+		tag, _, n, err := nextPacket(data[off:])
+		if err != nil {
+			break
+		}
+		if tag == tagSecretKey || tag == tagSecretSubkey {
+			pkt := data[off : off+n]
+			if pk, err := readPrivateKeyPacket(pkt); err == nil && pk.Encrypted {
+				if protected == nil {
+					protected = make(map[[20]byte][]byte)
+				}
+				protected[pk.Fingerprint] = append([]byte(nil), pkt...)
+			}
+		}
+		off += n
+	}
+	return protected
+}
+
+// protectEntity returns a copy of e in which the primary key and all
+// subkeys are protected with passphrase, along with a copy of its extras
+// x holding the protected packets. The keys of the copy are locked.
+func protectEntity(e *openpgp.Entity, x *keyExtras, passphrase []byte, rand io.Reader) (*openpgp.Entity, *keyExtras, error) {
+	if e.PrivateKey == nil {
+		return nil, nil, errors.New("no private key")
+	}
+	px := x.clone()
+	px.protected = nil
+	priv, pkt, err := protectKey(e.PrivateKey, passphrase, rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	px.setProtected(priv.Fingerprint, pkt)
+	pe := *e
+	pe.PrimaryKey, pe.PrivateKey = &priv.PublicKey, priv
+	pe.Subkeys = make([]openpgp.Subkey, len(e.Subkeys))
+	for i, sk := range e.Subkeys {
+		if sk.PrivateKey != nil {
+			if sk.PrivateKey, pkt, err = protectKey(sk.PrivateKey, passphrase, rand); err != nil {
+				return nil, nil, err
+			}
+			px.setProtected(sk.PrivateKey.Fingerprint, pkt)
+			sk.PublicKey = &sk.PrivateKey.PublicKey
+		}
+		pe.Subkeys[i] = sk
+	}
+	return &pe, px, nil
+}
+
+// protectKey encrypts the unlocked key priv with passphrase and returns
+// the locked key read back from the protected packet, along with the
+// packet.
+func protectKey(priv *packet.PrivateKey, passphrase []byte, rand io.Reader) (*packet.PrivateKey, []byte, error) {
+	pkt, err := protectedKeyPacket(priv, passphrase, rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	pk, err := readPrivateKeyPacket(pkt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pk, pkt, nil
+}
+
+func protectedKeyPacket(priv *packet.PrivateKey, passphrase []byte, rand io.Reader) ([]byte, error) {
+	if priv.Encrypted {
+		return nil, errLockedKey
+	}
+	b := &bytes.Buffer{}
+	if err := priv.Serialize(b); err != nil {
+		return nil, err
+	}
+	tag, body, _, err := nextPacket(b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	pub, err := publicKeyBody(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	// body is the public key, a zero S2K usage, the key material and a
+	// two byte checksum
+	if len(body) < len(pub)+3 || body[len(pub)] != 0 {
+		return nil, errors.New("unexpected secret key encoding")
+	}
+	material := body[len(pub)+1 : len(body)-2]
+
+	salt := make([]byte, 8)
+	iv := make([]byte, protectIVSize)
+	if _, err := io.ReadFull(rand, salt); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand, iv); err != nil {
+		return nil, err
+	}
+	key := make([]byte, protectKeySize)
+	s2k.Iterated(key, sha256.New(), passphrase, salt, s2kCount(s2kCountByte))
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(material)
+	data := append(append([]byte(nil), material...), sum[:]...)
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(data, data)
+
+	out := &bytes.Buffer{}
+	out.Write(pub)
+	out.Write([]byte{s2kUsageSHA1, s2kCipherAES, s2kIterated, s2kHashSHA256})
+	out.Write(salt)
+	out.WriteByte(s2kCountByte)
+	out.Write(iv)
+	out.Write(data)
+	pkt := &bytes.Buffer{}
+	if err := writePacket(pkt, tag, out.Bytes()); err != nil {
+		return nil, err
+	}
+	return pkt.Bytes(), nil
+}
+
+// s2kCount decodes the iteration count of an iterated and salted S2K,
+// RFC 4880 section 3.7.1.3.
+func s2kCount(c byte) int {
+	return (16 + int(c&15)) << (uint32(c>>4) + 6)
+}
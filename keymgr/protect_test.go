@@ -0,0 +1,80 @@
+package keymgr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp/armor"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestGenerateProtectedKey(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	params := &KeyParams{Bits: 1024, Passphrase: []byte("secret")}
+	e, err := generateNewKey("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.PrivateKey.Encrypted || !e.Subkeys[0].PrivateKey.Encrypted {
+		t.Fatal("generated key is not protected")
+	}
+
+	// the stored key is protected as well
+	data, err := ioutil.ReadFile(nymsPath(secretKeyringFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &loadReport{}
+	el := readKeyringData("nymskeys.sec", 0, data, r)
+	if len(el) != 1 || !el[0].PrivateKey.Encrypted {
+		t.Fatal("key in secret keyring is not protected")
+	}
+	k := el[0]
+	if err := k.PrivateKey.Decrypt([]byte("wrong")); err == nil {
+		t.Error("key unlocked with wrong passphrase")
+	}
+	for _, priv := range []*packet.PrivateKey{k.PrivateKey, k.Subkeys[0].PrivateKey} {
+		if err := priv.Decrypt([]byte("secret")); err != nil {
+			t.Fatalf("error unlocking key: %v", err)
+		}
+	}
+
+	// unlocking does not cause the key material to be written in the clear
+	b := &bytes.Buffer{}
+	if err := serializeEntity(b, k, r.extras[k], true); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Error("unlocked key was not written in protected form")
+	}
+}
+
+func TestLoadedProtectedKeyIsKept(t *testing.T) {
+	block, err := armor.Decode(strings.NewReader(testDataMap["user4"].seckey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &loadReport{}
+	el := readKeyringData("secring.gpg", 0, data, r)
+	if len(el) != 1 {
+		t.Fatalf("expecting 1 key, got %d", len(el))
+	}
+	e := el[0]
+	if err := e.PrivateKey.Decrypt([]byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	b := &bytes.Buffer{}
+	if err := serializeEntity(b, e, r.extras[e], true); err != nil {
+		t.Fatal(err)
+	}
+	_, _, n, _ := nextPacket(data)
+	if !bytes.HasPrefix(b.Bytes(), data[:n]) {
+		t.Error("protected primary key packet was not preserved")
+	}
+}
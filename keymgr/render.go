@@ -3,41 +3,97 @@ package keymgr
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"crypto/dsa"
+	"crypto/ecdsa"
 	"crypto/rsa"
 
 	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/elgamal"
 	"code.google.com/p/go.crypto/openpgp/packet"
 )
 
+// pubKeyAlgoEdDSA is the algorithm id of EdDSA keys, which the openpgp
+// package does not know about.
+const pubKeyAlgoEdDSA = 22
+
 func RenderKey(e *openpgp.Entity) string {
 	lines := []string{}
-	lines = append(lines, renderPublicKey(e.PrimaryKey))
+	lines = append(lines, renderPublicKey(e.PrimaryKey, KeyExpiration(e)))
 
 	for _, v := range e.Identities {
 		lines = append(lines, fmt.Sprintf("uid     %s", v.Name))
 	}
+	x := defaultKeys.lookupExtras(e)
+	for _, sk := range e.Subkeys {
+		lines = append(lines, renderPublicKey(sk.PublicKey, subkeyExpiration(sk, x)))
+	}
 
 	return strings.Join(lines, "\n")
 }
 
-func renderPublicKey(pk *packet.PublicKey) string {
-	ktag := renderKeyTag(pk.PublicKey)
+func renderPublicKey(pk *packet.PublicKey, expires time.Time) string {
+	ktag := renderKeyTag(pk)
+	var line string
 	if pk.IsSubkey {
-		return fmt.Sprintf("sub   %s/%X", ktag, uint32(pk.KeyId&0xFFFFFFFF))
+		line = fmt.Sprintf("sub   %s/%X", ktag, uint32(pk.KeyId&0xFFFFFFFF))
 	} else {
-		return fmt.Sprintf("pub   %s/%X", ktag, uint32(pk.KeyId&0xFFFFFFFF))
+		line = fmt.Sprintf("pub   %s/%X", ktag, uint32(pk.KeyId&0xFFFFFFFF))
 	}
+	return line + renderExpiration(expires, time.Now())
 }
 
-func renderKeyTag(k interface{}) string {
-	switch key := k.(type) {
+// renderExpiration returns the expiration note GnuPG appends to a key,
+// or nothing for a key which does not expire.
+func renderExpiration(expires, now time.Time) string {
+	switch {
+	case expires.IsZero():
+		return ""
+	case now.After(expires):
+		return fmt.Sprintf(" [expired: %s]", expires.Format("2006-01-02"))
+	default:
+		return fmt.Sprintf(" [expires: %s]", expires.Format("2006-01-02"))
+	}
+}
+
+// renderKeyTag returns the key size and the algorithm letter GnuPG uses
+// for pk. ECDH keys carry an *ecdsa.PublicKey as well and are told apart
+// by their algorithm.
+func renderKeyTag(pk *packet.PublicKey) string {
+	switch key := pk.PublicKey.(type) {
 	case *rsa.PublicKey:
 		return fmt.Sprintf("%dR", key.N.BitLen())
 	case *dsa.PublicKey:
 		return fmt.Sprintf("%dD", key.P.BitLen())
+	case *elgamal.PublicKey:
+		return fmt.Sprintf("%dg", key.P.BitLen())
+	case *ecdsa.PublicKey:
+		if pk.PubKeyAlgo == packet.PubKeyAlgoECDH {
+			return fmt.Sprintf("%de", key.Curve.Params().BitSize)
+		}
+		return fmt.Sprintf("%dE", key.Curve.Params().BitSize)
 	default:
 		return "??"
 	}
 }
+
+// algorithmName returns a readable name for a public key algorithm id,
+// including the ones the openpgp package cannot parse.
+func algorithmName(algo packet.PublicKeyAlgorithm) string {
+	switch algo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		return "RSA"
+	case packet.PubKeyAlgoElGamal:
+		return "ElGamal"
+	case packet.PubKeyAlgoDSA:
+		return "DSA"
+	case packet.PubKeyAlgoECDH:
+		return "ECDH"
+	case packet.PubKeyAlgoECDSA:
+		return "ECDSA"
+	case pubKeyAlgoEdDSA:
+		return "EdDSA"
+	}
+	return fmt.Sprintf("algorithm %d", algo)
+}
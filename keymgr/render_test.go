@@ -0,0 +1,61 @@
+package keymgr
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestRenderKeyTag(t *testing.T) {
+	e := toEntity(testDataMap["user1"].pubkey)
+	if tag := renderKeyTag(e.PrimaryKey); !strings.HasSuffix(tag, "R") {
+		t.Errorf("RSA key rendered as %s", tag)
+	}
+
+	k, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := &packet.NewECDSAPrivateKey(time.Now(), k).PublicKey
+	if tag := renderKeyTag(pk); tag != "384E" {
+		t.Errorf("ECDSA key rendered as %s, expecting 384E", tag)
+	}
+	ecdh := &packet.PublicKey{PubKeyAlgo: packet.PubKeyAlgoECDH, PublicKey: &k.PublicKey}
+	if tag := renderKeyTag(ecdh); tag != "384e" {
+		t.Errorf("ECDH key rendered as %s, expecting 384e", tag)
+	}
+}
+
+func TestRenderSubkeys(t *testing.T) {
+	e := toEntity(testDataMap["user1"].pubkey)
+	lines := strings.Split(RenderKey(e), "\n")
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, "sub   ") {
+		t.Errorf("subkey not rendered, last line is %q", last)
+	}
+}
+
+func TestDescribeUnsupportedKey(t *testing.T) {
+	r := &loadReport{}
+	readKeyringData("pubring.gpg", 0, ed25519PublicKeyPacket(tagPublicKey), r)
+	if len(r.diagnostics) != 1 || !strings.Contains(r.diagnostics[0].Reason, "EdDSA") {
+		t.Errorf("unexpected diagnostics %v", r.diagnostics)
+	}
+}
+
+func TestRenderExpiration(t *testing.T) {
+	now := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	if s := renderExpiration(time.Time{}, now); s != "" {
+		t.Errorf("key without expiration rendered as %q", s)
+	}
+	if s := renderExpiration(now.AddDate(1, 0, 0), now); s != " [expires: 2016-06-01]" {
+		t.Errorf("unexpected expiration %q", s)
+	}
+	if s := renderExpiration(now.AddDate(0, 0, -1), now); s != " [expired: 2015-05-31]" {
+		t.Errorf("unexpected expiration %q", s)
+	}
+}
@@ -0,0 +1,153 @@
+package keymgr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/armor"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// revocationDirectory is the subdirectory of the nyms directory holding
+// the revocation certificates made when keys are generated.
+const revocationDirectory = "revocs"
+
+var errNoRevocation = errors.New("no key revocation certificate found")
+
+// RevocationCertificate returns the armored revocation certificate stored
+// for the key with the given fingerprint when it was generated.
+func RevocationCertificate(fingerprint [20]byte) (string, error) {
+	data, err := ioutil.ReadFile(revocationPath(fingerprint))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// ImportRevocation applies an armored or binary key revocation
+// certificate to the matching key and stores the revoked key in the nyms
+// keyrings. The revoked public key is returned.
+func ImportRevocation(data []byte) (*openpgp.Entity, error) {
+	sig, err := readRevocation(data)
+	if err != nil {
+		return nil, err
+	}
+	var revoked *openpgp.Entity
+	err = defaultKeys.update(func(store *keyStore) error {
+		k := store.findRevokedKey(sig)
+		if k == nil {
+			return errKeyNotFound
+		}
+		fp := k.PrimaryKey.Fingerprint
+		pub := findEntity(store.nyms.public, fp)
+		px := store.nyms.extras[pub]
+		if pub == nil {
+			pub, px = publicEntity(k), store.extras(k).public()
+		}
+		if revoked = addRevocation(pub, sig); revoked != pub {
+			if err := store.replace(revoked, px, false); err != nil {
+				return err
+			}
+		}
+		if sec := findEntity(store.nyms.secret, fp); sec != nil {
+			if r := addRevocation(sec, sig); r != sec {
+				return store.replace(r, store.nyms.extras[sec], true)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// readRevocation returns the key revocation signature of a revocation
+// certificate.
+func readRevocation(data []byte) (*packet.Signature, error) {
+	blocks, err := decodeKeyBlocks(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range blocks {
+		for off := 0; off < len(b); {
+			tag, _, n, err := nextPacket(b[off:])
+			if err != nil {
+				return nil, err
+			}
+			if tag == tagSignature {
+				if sig, ok := readSignaturePacket(b[off : off+n]); ok && sig.SigType == packet.SigTypeKeyRevocation {
+					return sig, nil
+				}
+			}
+			off += n
+		}
+	}
+	return nil, errNoRevocation
+}
+
+// findRevokedKey returns the public key which made the revocation sig, the
+// lock must be held.
+func (store *keyStore) findRevokedKey(sig *packet.Signature) *openpgp.Entity {
+	if sig.IssuerKeyId == nil {
+		return nil
+	}
+	for _, e := range store.publicIndex.lookupKeyId(*sig.IssuerKeyId) {
+		if e.PrimaryKey.VerifyRevocationSignature(sig) == nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// addRevocation returns a copy of e revoked by sig, or e itself if it
+// already carries sig.
+func addRevocation(e *openpgp.Entity, sig *packet.Signature) *openpgp.Entity {
+	if containsSignature(e.Revocations, sig) {
+		return e
+	}
+	c := copyEntity(e)
+	c.Revocations = append(c.Revocations, sig)
+	return c
+}
+
+// storeRevocationCertificate makes a revocation certificate for e, whose
+// primary key must be unlocked, and writes it to the revocation directory
+// readable only by the current user.
+func storeRevocationCertificate(e *openpgp.Entity, config *packet.Config) error {
+	b := newRevocationBuilder(packet.SigTypeKeyRevocation, ReasonNone, "", config.Now())
+	sig, err := b.signDirect(e.PrimaryKey, e.PrivateKey, config.Random())
+	if err != nil {
+		return err
+	}
+	cert := &bytes.Buffer{}
+	if err := writeRevocationCertificate(cert, sig); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(nymsPath(revocationDirectory), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(revocationPath(e.PrimaryKey.Fingerprint), cert.Bytes(), 0600)
+}
+
+func writeRevocationCertificate(w io.Writer, sig *packet.Signature) error {
+	headers := map[string]string{"Comment": "This is a revocation certificate"}
+	aw, err := armor.Encode(w, publicKeyArmorHeader, headers)
+	if err != nil {
+		return err
+	}
+	if err := sig.Serialize(aw); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+func revocationPath(fingerprint [20]byte) string {
+	return nymsPath(filepath.Join(revocationDirectory, fmt.Sprintf("%X.rev", fingerprint)))
+}
@@ -0,0 +1,191 @@
+package keymgr
+
+import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// Reasons for revocation, RFC 4880 section 5.2.3.23
+const (
+	ReasonNone          = 0
+	ReasonSuperseded    = 1
+	ReasonCompromised   = 2
+	ReasonRetired       = 3
+	ReasonUserIdInvalid = 32
+)
+
+var errInvalidReason = errors.New("invalid reason for revocation")
+var errSubkeyNotFound = errors.New("subkey not found")
+var errUserIdNotFound = errors.New("user id not found")
+var errAlreadyRevoked = errors.New("already revoked")
+
+// RevokeKey revokes the key with the given fingerprint, which must be in
+// the nyms secret keyring, giving reason as one of ReasonNone,
+// ReasonSuperseded, ReasonCompromised or ReasonRetired. If the secret key
+// is locked it is unlocked with passphrase. The revoked secret key is
+// returned.
+func RevokeKey(fingerprint [20]byte, reason int, text string, passphrase []byte) (*openpgp.Entity, error) {
+	if !isKeyRevocationReason(reason) {
+		return nil, errInvalidReason
+	}
+	return revoke(fingerprint, passphrase, func(e *openpgp.Entity, signer *packet.PrivateKey) (*packet.Signature, error) {
+		if len(e.Revocations) > 0 {
+			return nil, errAlreadyRevoked
+		}
+		b := newRevocationBuilder(packet.SigTypeKeyRevocation, reason, text, time.Now())
+		return b.signDirect(e.PrimaryKey, signer, rand.Reader)
+	}, func(e *openpgp.Entity, _ *keyExtras, sig *packet.Signature) {
+		e.Revocations = append(e.Revocations, sig)
+	})
+}
+
+// RevokeSubkey revokes the subkey with the given key id of the key with
+// the given fingerprint like RevokeKey.
+func RevokeSubkey(fingerprint [20]byte, subkeyId uint64, reason int, text string, passphrase []byte) (*openpgp.Entity, error) {
+	if !isKeyRevocationReason(reason) {
+		return nil, errInvalidReason
+	}
+	return revoke(fingerprint, passphrase, func(e *openpgp.Entity, signer *packet.PrivateKey) (*packet.Signature, error) {
+		i := findSubkeyById(e, subkeyId)
+		if i < 0 {
+			return nil, errSubkeyNotFound
+		}
+		sk := e.Subkeys[i]
+		if sk.Sig.SigType == packet.SigTypeSubkeyRevocation {
+			return nil, errAlreadyRevoked
+		}
+		b := newRevocationBuilder(packet.SigTypeSubkeyRevocation, reason, text, time.Now())
+		return b.signKey(e.PrimaryKey, sk.PublicKey, signer, rand.Reader)
+	}, func(e *openpgp.Entity, x *keyExtras, sig *packet.Signature) {
+		if i := findSubkeyById(e, subkeyId); i >= 0 {
+			sk := &e.Subkeys[i]
+			if sk.Sig.SigType == packet.SigTypeSubkeyBinding {
+				x.setBinding(sk.PublicKey.Fingerprint, sk.Sig)
+			}
+			sk.Sig = sig
+		}
+	})
+}
+
+// RevokeUserId revokes the user id of the key with the given fingerprint
+// like RevokeKey, giving reason as ReasonNone or ReasonUserIdInvalid.
+func RevokeUserId(fingerprint [20]byte, id string, reason int, text string, passphrase []byte) (*openpgp.Entity, error) {
+	if reason != ReasonNone && reason != ReasonUserIdInvalid {
+		return nil, errInvalidReason
+	}
+	return revoke(fingerprint, passphrase, func(e *openpgp.Entity, signer *packet.PrivateKey) (*packet.Signature, error) {
+		ident, ok := e.Identities[id]
+		if !ok {
+			return nil, errUserIdNotFound
+		}
+		if isUserIdRevoked(e, id, ident) {
+			return nil, errAlreadyRevoked
+		}
+		b := newRevocationBuilder(sigTypeCertificationRevocation, reason, text, time.Now())
+		return b.signUserId(id, e.PrimaryKey, signer, rand.Reader)
+	}, func(e *openpgp.Entity, _ *keyExtras, sig *packet.Signature) {
+		if ident, ok := e.Identities[id]; ok {
+			ident.Signatures = append(ident.Signatures, sig)
+		}
+	})
+}
+
+// revoke signs a revocation with the primary key of the key with the
+// given fingerprint and adds it to the key and its extras using apply.
+func revoke(fingerprint [20]byte, passphrase []byte, sign func(*openpgp.Entity, *packet.PrivateKey) (*packet.Signature, error), apply func(*openpgp.Entity, *keyExtras, *packet.Signature)) (*openpgp.Entity, error) {
+	return changeKey(fingerprint, passphrase, func(e *openpgp.Entity, x *keyExtras, signer *packet.PrivateKey) (func(*openpgp.Entity, *keyExtras), error) {
+		sig, err := sign(e, signer)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *openpgp.Entity, cx *keyExtras) { apply(c, cx, sig) }, nil
+	})
+}
+
+func newRevocationBuilder(sigType packet.SignatureType, reason int, text string, created time.Time) *signatureBuilder {
+	b := newSignatureBuilder(sigType, crypto.SHA256, created)
+	b.add(subpacketRevocationReason, append([]byte{byte(reason)}, text...)...)
+	return b
+}
+
+func isKeyRevocationReason(reason int) bool {
+	return reason >= ReasonNone && reason <= ReasonRetired
+}
+
+func findSubkeyById(e *openpgp.Entity, keyId uint64) int {
+	for i, sk := range e.Subkeys {
+		if sk.PublicKey.KeyId == keyId {
+			return i
+		}
+	}
+	return -1
+}
+
+// isUserIdRevoked reports whether ident carries a revocation made by the
+// primary key of e.
+func isUserIdRevoked(e *openpgp.Entity, name string, ident *openpgp.Identity) bool {
+	for _, sig := range ident.Signatures {
+		if isUserIdRevocation(e, name, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// revokedSubkeyBindings returns the newest binding signature of each
+// revoked subkey of a key read from a keyring by subkey fingerprint, or
+// nil if it has none.
+func revokedSubkeyBindings(data []byte) map[[20]byte]*packet.Signature {
+	var bindings map[[20]byte]*packet.Signature
+	sections, _ := splitSections(data)
+	for _, s := range sections {
+		if s.tag != tagPublicSubkey && s.tag != tagSecretSubkey {
+			continue
+		}
+		if !containsSignatureType(s.packets, packet.SigTypeSubkeyRevocation) {
+			continue
+		}
+		var binding *packet.Signature
+		for _, p := range s.packets {
+			sig, ok := readSignaturePacket(p)
+			if ok && sig.SigType == packet.SigTypeSubkeyBinding &&
+				(binding == nil || !sig.CreationTime.Before(binding.CreationTime)) {
+				binding = sig
+			}
+		}
+		if binding != nil {
+			if bindings == nil {
+				bindings = make(map[[20]byte]*packet.Signature)
+			}
+			_, body, _, _ := nextPacket(s.pkt)
+			bindings[keyPacketFingerprint(s.tag, body, s.pkt)] = binding
+		}
+	}
+	return bindings
+}
+
+// containsSignatureType reports whether packets include a signature of the
+// given type, without parsing the signatures.
+func containsSignatureType(packets [][]byte, sigType packet.SignatureType) bool {
+	for _, p := range packets {
+		tag, body, _, err := nextPacket(p)
+		if err != nil || tag != tagSignature || len(body) < 3 {
+			continue
+		}
+		// the signature type follows the version in version 4 signatures
+		// and the hashed material length in version 3 signatures
+		t := body[1]
+		if body[0] < 4 {
+			t = body[2]
+		}
+		if packet.SignatureType(t) == sigType {
+			return true
+		}
+	}
+	return false
+}
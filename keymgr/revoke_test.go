@@ -0,0 +1,140 @@
+package keymgr
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestRevoke(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	params := &KeyParams{Bits: 1024, Passphrase: []byte("password")}
+	e, err := generateNewKey("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+	var id string
+	for name := range e.Identities {
+		id = name
+	}
+	subkeyId := e.Subkeys[0].PublicKey.KeyId
+
+	if _, err := RevokeKey(fp, ReasonUserIdInvalid, "", nil); err != errInvalidReason {
+		t.Errorf("revoking key with user id reason returned %v", err)
+	}
+	if _, err := RevokeKey(fp, ReasonRetired, "", []byte("wrong")); err != errWrongPassphrase {
+		t.Errorf("revoking key with wrong passphrase returned %v", err)
+	}
+	if _, err := RevokeSubkey(fp, 1, ReasonRetired, "", []byte("password")); err != errSubkeyNotFound {
+		t.Errorf("revoking missing subkey returned %v", err)
+	}
+
+	if _, err := RevokeUserId(fp, id, ReasonUserIdInvalid, "moved", []byte("password")); err != nil {
+		t.Fatalf("error revoking user id: %v", err)
+	}
+	if _, err := RevokeUserId(fp, id, ReasonNone, "", []byte("password")); err != errAlreadyRevoked {
+		t.Errorf("revoking user id twice returned %v", err)
+	}
+	if _, err := RevokeSubkey(fp, subkeyId, ReasonSuperseded, "rotated", []byte("password")); err != nil {
+		t.Fatalf("error revoking subkey: %v", err)
+	}
+	revoked, err := RevokeKey(fp, ReasonCompromised, "lost laptop", []byte("password"))
+	if err != nil {
+		t.Fatalf("error revoking key: %v", err)
+	}
+	if primary, _ := DescribeKey(revoked); !primary.HasSecretKey || !primary.Revoked {
+		t.Errorf("revoked key reported as %+v", primary)
+	}
+
+	nyms, _, _ := loadKeyrings()
+	for _, k := range []*openpgp.Entity{nyms.public[0], nyms.secret[0]} {
+		if len(k.Revocations) != 1 || !hasReason(k.Revocations[0], ReasonCompromised, "lost laptop") {
+			t.Error("stored key revocation missing or without reason")
+		}
+		if sig := k.Subkeys[0].Sig; sig.SigType != packet.SigTypeSubkeyRevocation || !hasReason(sig, ReasonSuperseded, "rotated") {
+			t.Error("stored subkey revocation missing or without reason")
+		}
+		if !isUserIdRevoked(k, id, k.Identities[id]) {
+			t.Error("stored user id revocation missing")
+		}
+	}
+	if k := KeySource().GetPublicKeyById(e.PrimaryKey.KeyId); k == nil || len(k.Revocations) != 1 {
+		t.Error("revoked key not returned by key source")
+	}
+
+	// the subkey binding is kept next to the revocation
+	data, err := ioutil.ReadFile(nymsPath(publicKeyringFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections, _ := splitSections(data)
+	for _, s := range sections {
+		if s.tag == tagPublicSubkey && !containsSignatureType(s.packets, packet.SigTypeSubkeyBinding) {
+			t.Error("subkey binding signature dropped from keyring file")
+		}
+	}
+
+	// and read back along with the key
+	for _, k := range []*openpgp.Entity{nyms.public[0], nyms.secret[0]} {
+		if nyms.extras[k].binding(k.Subkeys[0].PublicKey.Fingerprint) == nil {
+			t.Error("binding of revoked subkey not kept when loading keyring")
+		}
+	}
+}
+
+func hasReason(sig *packet.Signature, reason int, text string) bool {
+	return sig.RevocationReason != nil && int(*sig.RevocationReason) == reason && sig.RevocationReasonText == text
+}
+
+func TestRevocationCertificate(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	params := &KeyParams{Bits: 1024, Passphrase: []byte("password")}
+	e, err := generateNewKey("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+	fi, err := os.Stat(revocationPath(fp))
+	if err != nil {
+		t.Fatalf("revocation certificate not stored: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("revocation certificate stored with mode %v", fi.Mode().Perm())
+	}
+	cert, err := RevocationCertificate(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := toEntity(testDataMap["user1"].pubkey)
+	if err := AddPublicKey(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportRevocation([]byte(testDataMap["user1"].pubkey)); err != errNoRevocation {
+		t.Errorf("importing key as revocation returned %v", err)
+	}
+
+	revoked, err := ImportRevocation([]byte(cert))
+	if err != nil {
+		t.Fatalf("error importing revocation: %v", err)
+	}
+	if revoked.PrimaryKey.Fingerprint != fp || len(revoked.Revocations) != 1 {
+		t.Fatal("revocation not applied to the generated key")
+	}
+	nyms, _, _ := loadKeyrings()
+	for _, el := range []openpgp.EntityList{nyms.public, nyms.secret} {
+		if k := findEntity(el, fp); k == nil || len(k.Revocations) != 1 {
+			t.Error("stored key is not revoked")
+		}
+	}
+	if k := findEntity(nyms.public, other.PrimaryKey.Fingerprint); len(k.Revocations) != 0 {
+		t.Error("revocation applied to unrelated key")
+	}
+	if again, err := ImportRevocation([]byte(cert)); err != nil || len(again.Revocations) != 1 {
+		t.Errorf("importing revocation twice returned %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+package keymgr
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// Purposes a key is selected for
+const (
+	purposeEncrypt = iota
+	purposeSign
+)
+
+// Trust levels used to rank usable keys, higher is better
+const (
+	trustNone      = iota // only in the GnuPG keyrings
+	trustNyms             // stored in the nyms keyring
+	trustCertified        // a user id is certified by one of our keys
+	trustOwn              // we hold the secret key
+)
+
+// SkippedKey records a key which was passed over when selecting a key for
+// an address and the reason why.
+type SkippedKey struct {
+	Fingerprint string
+	Reason      string
+}
+
+// NoUsableKeyError describes why none of the keys for an address can be
+// used, see UnusableKeys.
+type NoUsableKeyError struct {
+	Address string
+	Skipped []SkippedKey
+}
+
+func (e *NoUsableKeyError) Error() string {
+	reasons := make([]string, len(e.Skipped))
+	for i, s := range e.Skipped {
+		reasons[i] = s.Fingerprint + ": " + s.Reason
+	}
+	return fmt.Sprintf("no usable key for %s (%s)", e.Address, strings.Join(reasons, "; "))
+}
+
+// UnusableKeys reports why GetPublicKey, or GetSecretKey if secret is set,
+// found no usable key for address. Nil is returned if there is a usable
+// key or no key for the address at all.
+func UnusableKeys(address string, secret bool) *NoUsableKeyError {
+	return defaultKeys.unusableKeys(address, secret)
+}
+
+func (store *keyStore) unusableKeys(address string, secret bool) *NoUsableKeyError {
+	purpose := purposeEncrypt
+	if secret {
+		purpose = purposeSign
+	}
+	k, skipped := store.selectKey(address, secret, purpose)
+	if k != nil || len(skipped) == 0 {
+		return nil
+	}
+	return &NoUsableKeyError{Address: address, Skipped: skipped}
+}
+
+// selectKey returns the best key for address and purpose from the public
+// or secret keys. Keys which are revoked, expired or lack a valid key for
+// the purpose are skipped. The remaining keys are ranked by trust and then
+// by creation time, newest first. The skipped keys are returned along with
+// the reasons.
+func (store *keyStore) selectKey(address string, secret bool, purpose int) (*openpgp.Entity, []SkippedKey) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	index := store.publicIndex
+	if secret {
+		index = store.secretIndex
+	}
+	el := index.lookupEmail(address)
+	if len(el) == 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	var best *openpgp.Entity
+	bestTrust := 0
+	var skipped []SkippedKey
+	for _, e := range el {
+		if reason := unusableReason(e, purpose, now); reason != "" {
+			fp := hex.EncodeToString(e.PrimaryKey.Fingerprint[:])
+			skipped = append(skipped, SkippedKey{fp, reason})
+			continue
+		}
+		trust := store.keyTrust(e)
+		if best == nil || trust > bestTrust ||
+			(trust == bestTrust && e.PrimaryKey.CreationTime.After(best.PrimaryKey.CreationTime)) {
+			best, bestTrust = e, trust
+		}
+	}
+	return best, skipped
+}
+
+// unusableReason returns why e cannot be used for purpose at now, or an
+// empty string if it can.
+func unusableReason(e *openpgp.Entity, purpose int, now time.Time) string {
+	if isKeyRevoked(e) {
+		return "key is revoked"
+	}
+	if expires := KeyExpiration(e); !expires.IsZero() && now.After(expires) {
+		return "key expired on " + expires.Format("2006-01-02")
+	}
+	switch purpose {
+	case purposeEncrypt:
+		if !canEncrypt(e, now) {
+			return "no valid encryption key"
+		}
+	case purposeSign:
+		if !canSign(e, now) {
+			return "no valid signing key"
+		}
+	}
+	return ""
+}
+
+// isKeyRevoked reports whether e carries a valid revocation made by its
+// primary key.
+func isKeyRevoked(e *openpgp.Entity) bool {
+	for _, sig := range e.Revocations {
+		if e.PrimaryKey.VerifyRevocationSignature(sig) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func canEncrypt(e *openpgp.Entity, now time.Time) bool {
+	for _, sk := range e.Subkeys {
+		if validSubkey(sk, now) && sk.Sig.FlagsValid &&
+			(sk.Sig.FlagEncryptCommunications || sk.Sig.FlagEncryptStorage) &&
+			sk.PublicKey.PubKeyAlgo.CanEncrypt() {
+			return true
+		}
+	}
+	sig := primarySelfSignature(e)
+	return sig != nil && (!sig.FlagsValid || sig.FlagEncryptCommunications) &&
+		e.PrimaryKey.PubKeyAlgo.CanEncrypt()
+}
+
+func canSign(e *openpgp.Entity, now time.Time) bool {
+	sig := primarySelfSignature(e)
+	if sig != nil && (!sig.FlagsValid || sig.FlagSign) && e.PrimaryKey.PubKeyAlgo.CanSign() {
+		return true
+	}
+	for _, sk := range e.Subkeys {
+		if validSubkey(sk, now) && sk.Sig.FlagsValid && sk.Sig.FlagSign &&
+			sk.PublicKey.PubKeyAlgo.CanSign() {
+			return true
+		}
+	}
+	return false
+}
+
+// validSubkey reports whether sk is neither revoked nor expired.
+func validSubkey(sk openpgp.Subkey, now time.Time) bool {
+	return sk.Sig.SigType == packet.SigTypeSubkeyBinding && !subkeyExpired(sk, now)
+}
+
+// primarySelfSignature returns the self signature of the primary identity
+// of e, or nil if all user ids of e are revoked.
+func primarySelfSignature(e *openpgp.Entity) *packet.Signature {
+	if ident := primaryIdentity(e); ident != nil {
+		return ident.SelfSignature
+	}
+	return nil
+}
+
+// keyTrust returns the trust level of e, the lock must be held.
+func (store *keyStore) keyTrust(e *openpgp.Entity) int {
+	fp := e.PrimaryKey.Fingerprint
+	if store.secretIndex.lookupFingerprint(fp) != nil {
+		return trustOwn
+	}
+	if store.certifiedByOwnKey(e) {
+		return trustCertified
+	}
+	if findEntity(store.nyms.public, fp) != nil {
+		return trustNyms
+	}
+	return trustNone
+}
+
+// certifiedByOwnKey reports whether a user id of e carries a valid
+// certification made by one of the secret keys, the lock must be held.
+func (store *keyStore) certifiedByOwnKey(e *openpgp.Entity) bool {
+	for name, ident := range e.Identities {
+		for _, sig := range ident.Signatures {
+			if sig.IssuerKeyId == nil || sig.SigType < packet.SigTypeGenericCert || sig.SigType > packet.SigTypePositiveCert {
+				continue
+			}
+			for _, k := range store.secretIndex.lookupKeyId(*sig.IssuerKeyId) {
+				if k.PrimaryKey.VerifyUserIdSignature(name, e.PrimaryKey, sig) == nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package keymgr
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// selectionKey generates a key for user@example.com created at the given
+// time before now.
+func selectionKey(t *testing.T, age, lifetime time.Duration) *openpgp.Entity {
+	created := time.Now().Add(-age)
+	config := &packet.Config{Time: func() time.Time { return created }}
+	params := &KeyParams{Algorithm: "ecdsa", Bits: 1024, Lifetime: lifetime}
+	e, err := newEntity("User", "", "user@example.com", params, config)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	return e
+}
+
+func TestSelectKey(t *testing.T) {
+	older := selectionKey(t, 2*time.Hour, 0)
+	newer := selectionKey(t, time.Hour, 0)
+	expired := selectionKey(t, 2*time.Hour, time.Hour)
+	revoked := selectionKey(t, 0, 0)
+	b := newRevocationBuilder(packet.SigTypeKeyRevocation, ReasonCompromised, "", time.Now())
+	sig, err := b.signDirect(revoked.PrimaryKey, revoked.PrivateKey, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked.Revocations = append(revoked.Revocations, sig)
+	signOnly := selectionKey(t, 0, 0)
+	signOnly.Subkeys = nil
+
+	store := &keyStore{nyms: keyring{public: openpgp.EntityList{expired, revoked, older, newer, signOnly}}}
+	store.rebuild()
+	if k, err := store.GetPublicKey("user@example.com"); err != nil || k != newer {
+		t.Errorf("expected newest usable key, got %v, %v", k, err)
+	}
+
+	own := selectionKey(t, 0, 0)
+	own.Identities = map[string]*openpgp.Identity{}
+	store.nyms.secret = openpgp.EntityList{own}
+	name := sortedIdentities(older)[0].Name
+	ident := older.Identities[name]
+	ident.Signatures = append(ident.Signatures, certify(t, older, name, own, packet.SigTypeGenericCert))
+	store.rebuild()
+	if k, _ := store.GetPublicKey("user@example.com"); k != older {
+		t.Error("key certified by own key not preferred")
+	}
+
+	store.nyms.secret = openpgp.EntityList{own, revoked, signOnly}
+	store.rebuild()
+	if k, err := store.GetSecretKey("user@example.com"); err != nil || k != signOnly {
+		t.Errorf("expected signing key, got %v, %v", k, err)
+	}
+}
+
+func TestSelectKeyReportsSkippedKeys(t *testing.T) {
+	expired := selectionKey(t, 2*time.Hour, time.Hour)
+	signOnly := selectionKey(t, 0, 0)
+	signOnly.Subkeys = nil
+	revoked := selectionKey(t, 0, 0)
+	b := newRevocationBuilder(packet.SigTypeKeyRevocation, ReasonRetired, "", time.Now())
+	sig, err := b.signDirect(revoked.PrimaryKey, revoked.PrivateKey, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked.Revocations = append(revoked.Revocations, sig)
+	// a revocation made by another key is ignored
+	signOnly.Revocations = append(signOnly.Revocations, sig)
+
+	store := &keyStore{nyms: keyring{public: openpgp.EntityList{expired, signOnly, revoked}}}
+	store.rebuild()
+	k, err := store.GetPublicKey("user@example.com")
+	if k != nil || err != nil {
+		t.Fatalf("unusable key selected: %v, %v", k, err)
+	}
+	nerr := store.unusableKeys("user@example.com", false)
+	if nerr == nil {
+		t.Fatal("no report of unusable keys")
+	}
+	expect := []string{"key expired on ", "no valid encryption key", "key is revoked"}
+	if len(nerr.Skipped) != len(expect) {
+		t.Fatalf("expected %d skipped keys, got %v", len(expect), nerr.Skipped)
+	}
+	for i, s := range nerr.Skipped {
+		if !strings.HasPrefix(s.Reason, expect[i]) {
+			t.Errorf("key %s skipped for %q, expecting %q", s.Fingerprint, s.Reason, expect[i])
+		}
+	}
+	if k, err := store.GetPublicKey("nobody@example.com"); k != nil || err != nil {
+		t.Errorf("lookup of unknown address returned %v, %v", k, err)
+	}
+	if nerr := store.unusableKeys("nobody@example.com", false); nerr != nil {
+		t.Errorf("unusable keys reported for unknown address: %v", nerr)
+	}
+}
@@ -0,0 +1,155 @@
+package keymgr
+
+import (
+	"errors"
+	"io"
+	"sort"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+var errLockedKey = errors.New("secret key is locked")
+
+// serializeEntity writes e with its extras x to w, including the secret
+// keys if secret is set. Unlike Entity.Serialize and
+// Entity.SerializePrivate it writes key revocations, user attributes and
+// the packets the openpgp package cannot parse, keeps existing signatures
+// instead of signing them again and writes the user ids in a stable order.
+func serializeEntity(w io.Writer, e *openpgp.Entity, x *keyExtras, secret bool) error {
+	if secret && e.PrivateKey == nil {
+		return errors.New("no private key")
+	}
+	if err := serializeKeyPacket(w, e.PrimaryKey, e.PrivateKey, x, secret); err != nil {
+		return err
+	}
+	for _, sig := range e.Revocations {
+		if err := sig.Serialize(w); err != nil {
+			return err
+		}
+	}
+	if err := writePackets(w, x.unparsedSignatures(keySectionId(e.PrimaryKey.Fingerprint))); err != nil {
+		return err
+	}
+	for _, ident := range sortedIdentities(e) {
+		if err := ident.UserId.Serialize(w); err != nil {
+			return err
+		}
+		if err := ident.SelfSignature.Serialize(w); err != nil {
+			return err
+		}
+		for _, sig := range ident.Signatures {
+			if err := sig.Serialize(w); err != nil {
+				return err
+			}
+		}
+		if err := writePackets(w, x.unparsedSignatures(sectionId(tagUserId, []byte(ident.UserId.Id), nil))); err != nil {
+			return err
+		}
+	}
+	if err := writeSections(w, x.unparsedSections(true, secret)); err != nil {
+		return err
+	}
+	if err := writeSections(w, x.userAttributes()); err != nil {
+		return err
+	}
+	for _, sk := range e.Subkeys {
+		if err := serializeKeyPacket(w, sk.PublicKey, sk.PrivateKey, x, secret); err != nil {
+			return err
+		}
+		if sk.Sig.SigType == packet.SigTypeSubkeyRevocation {
+			if binding := x.binding(sk.PublicKey.Fingerprint); binding != nil {
+				if err := binding.Serialize(w); err != nil {
+					return err
+				}
+			}
+		}
+		if err := sk.Sig.Serialize(w); err != nil {
+			return err
+		}
+		if err := writePackets(w, x.unparsedSignatures(keySectionId(sk.PublicKey.Fingerprint))); err != nil {
+			return err
+		}
+	}
+	return writeSections(w, x.unparsedSections(false, secret))
+}
+
+// writeSections writes the packets of sections as they were read.
+func writeSections(w io.Writer, sections []*keySection) error {
+	for _, s := range sections {
+		if _, err := w.Write(s.pkt); err != nil {
+			return err
+		}
+		if err := writePackets(w, s.packets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePackets(w io.Writer, packets [][]byte) error {
+	for _, p := range packets {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serializeKeyPacket writes the secret key packet for a key if secret is
+// set and it is available, or the public key packet otherwise. Keys
+// protected according to x are written in their protected form even when
+// unlocked.
+func serializeKeyPacket(w io.Writer, pub *packet.PublicKey, priv *packet.PrivateKey, x *keyExtras, secret bool) error {
+	if !secret || priv == nil {
+		return pub.Serialize(w)
+	}
+	if pkt := x.protectedPacket(priv.Fingerprint); pkt != nil {
+		_, err := w.Write(pkt)
+		return err
+	}
+	if priv.Encrypted {
+		return errLockedKey
+	}
+	return priv.Serialize(w)
+}
+
+// sortedIdentities returns the identities of e with the primary identity
+// first and the others ordered by name.
+func sortedIdentities(e *openpgp.Entity) []*openpgp.Identity {
+	idents := make([]*openpgp.Identity, 0, len(e.Identities))
+	for _, ident := range e.Identities {
+		idents = append(idents, ident)
+	}
+	sort.Sort(identityOrder(idents))
+	return idents
+}
+
+// primaryIdentity returns the identity of e which comes first in
+// sortedIdentities among the ones which are not revoked, or nil if all
+// user ids of e are revoked.
+func primaryIdentity(e *openpgp.Entity) *openpgp.Identity {
+	for _, ident := range sortedIdentities(e) {
+		if !isUserIdRevoked(e, ident.Name, ident) {
+			return ident
+		}
+	}
+	return nil
+}
+
+type identityOrder []*openpgp.Identity
+
+func (s identityOrder) Len() int      { return len(s) }
+func (s identityOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s identityOrder) Less(i, j int) bool {
+	pi, pj := isPrimaryIdentity(s[i]), isPrimaryIdentity(s[j])
+	if pi != pj {
+		return pi
+	}
+	return s[i].Name < s[j].Name
+}
+
+func isPrimaryIdentity(ident *openpgp.Identity) bool {
+	sig := ident.SelfSignature
+	return sig != nil && sig.IsPrimaryId != nil && *sig.IsPrimaryId
+}
@@ -0,0 +1,285 @@
+package keymgr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// sexp is a node of a parsed S-expression as used by gpg-agent to store
+// secret keys. A node is either an atom or a list of nodes.
+type sexp struct {
+	atom   []byte
+	list   []*sexp
+	isList bool
+}
+
+// name returns the first atom of a list, which by convention identifies
+// the list, or an empty string if there is none.
+func (s *sexp) name() string {
+	if !s.isList || len(s.list) == 0 || s.list[0].isList {
+		return ""
+	}
+	return string(s.list[0].atom)
+}
+
+// find performs a depth first search for a list named n.
+func (s *sexp) find(n string) *sexp {
+	if !s.isList {
+		return nil
+	}
+	if s.name() == n {
+		return s
+	}
+	for _, v := range s.list {
+		if found := v.find(n); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// value returns the atom following the name of the list named n.
+func (s *sexp) value(n string) []byte {
+	l := s.find(n)
+	if l == nil || len(l.list) < 2 || l.list[1].isList {
+		return nil
+	}
+	return l.list[1].atom
+}
+
+// mpi returns the value of the list named n as an unsigned integer.
+func (s *sexp) mpi(n string) *big.Int {
+	v := s.value(n)
+	if v == nil {
+		return nil
+	}
+	return new(big.Int).SetBytes(v)
+}
+
+// canonical returns the canonical encoding of s.
+func (s *sexp) canonical() []byte {
+	if !s.isList {
+		return append([]byte(strconv.Itoa(len(s.atom))+":"), s.atom...)
+	}
+	b := []byte{'('}
+	for _, v := range s.list {
+		b = append(b, v.canonical()...)
+	}
+	return append(b, ')')
+}
+
+// parseSexp parses a single S-expression in either the canonical or the
+// advanced (human readable) transport format. Trailing data, such as the
+// padding of a decrypted block, is ignored.
+func parseSexp(data []byte) (*sexp, error) {
+	p := &sexpParser{data: data}
+	return p.parse()
+}
+
+type sexpParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *sexpParser) skipSpace() {
+	for p.pos < len(p.data) && isSexpSpace(p.data[p.pos]) {
+		p.pos++
+	}
+}
+
+func isSexpSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isTokenChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		bytes.IndexByte([]byte("-./_:*+="), c) != -1
+}
+
+func (p *sexpParser) parse() (*sexp, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, errors.New("unexpected end of S-expression")
+	}
+	c := p.data[p.pos]
+	switch {
+	case c == '(':
+		return p.parseList()
+	case c == ')':
+		return nil, fmt.Errorf("unexpected ')' at offset %d", p.pos)
+	case c == '[':
+		// Display hints carry no information we need.
+		end := bytes.IndexByte(p.data[p.pos:], ']')
+		if end == -1 {
+			return nil, errors.New("unterminated display hint")
+		}
+		p.pos += end + 1
+		return p.parse()
+	case c >= '0' && c <= '9':
+		return p.parseVerbatim()
+	case c == '#':
+		return p.parseHex()
+	case c == '"':
+		return p.parseQuoted()
+	case c == '|':
+		return p.parseBase64()
+	case isTokenChar(c):
+		start := p.pos
+		for p.pos < len(p.data) && isTokenChar(p.data[p.pos]) {
+			p.pos++
+		}
+		return &sexp{atom: p.data[start:p.pos]}, nil
+	}
+	return nil, fmt.Errorf("unexpected character %q at offset %d", c, p.pos)
+}
+
+func (p *sexpParser) parseList() (*sexp, error) {
+	p.pos++
+	s := &sexp{isList: true}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, errors.New("unterminated list in S-expression")
+		}
+		if p.data[p.pos] == ')' {
+			p.pos++
+			return s, nil
+		}
+		v, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		s.list = append(s.list, v)
+	}
+}
+
+// parseVerbatim handles the length prefixed forms, "3:abc" in canonical
+// encoding, or a length in front of a hex, quoted or base64 string.
+func (p *sexpParser) parseVerbatim() (*sexp, error) {
+	start := p.pos
+	for p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '9' {
+		p.pos++
+	}
+	if p.pos >= len(p.data) {
+		return nil, errors.New("unexpected end of S-expression")
+	}
+	if p.data[p.pos] != ':' {
+		// The length is optional for the other string forms.
+		return p.parse()
+	}
+	n, err := strconv.Atoi(string(p.data[start:p.pos]))
+	if err != nil {
+		return nil, err
+	}
+	p.pos++
+	if n < 0 || p.pos+n > len(p.data) {
+		return nil, errors.New("verbatim string exceeds S-expression data")
+	}
+	s := &sexp{atom: p.data[p.pos : p.pos+n]}
+	p.pos += n
+	return s, nil
+}
+
+func (p *sexpParser) parseDelimited(delim byte) ([]byte, error) {
+	p.pos++
+	end := bytes.IndexByte(p.data[p.pos:], delim)
+	if end == -1 {
+		return nil, fmt.Errorf("unterminated %q string in S-expression", delim)
+	}
+	content := p.data[p.pos : p.pos+end]
+	p.pos += end + 1
+	return bytes.Map(func(r rune) rune {
+		if r < 0x80 && isSexpSpace(byte(r)) {
+			return -1
+		}
+		return r
+	}, content), nil
+}
+
+func (p *sexpParser) parseHex() (*sexp, error) {
+	content, err := p.parseDelimited('#')
+	if err != nil {
+		return nil, err
+	}
+	v, err := hex.DecodeString(string(content))
+	if err != nil {
+		return nil, err
+	}
+	return &sexp{atom: v}, nil
+}
+
+func (p *sexpParser) parseBase64() (*sexp, error) {
+	content, err := p.parseDelimited('|')
+	if err != nil {
+		return nil, err
+	}
+	v, err := base64.StdEncoding.DecodeString(string(content))
+	if err != nil {
+		return nil, err
+	}
+	return &sexp{atom: v}, nil
+}
+
+func (p *sexpParser) parseQuoted() (*sexp, error) {
+	p.pos++
+	out := []byte{}
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return &sexp{atom: out}, nil
+		case '\\':
+			if p.pos >= len(p.data) {
+				return nil, errors.New("unterminated escape in quoted string")
+			}
+			e := p.data[p.pos]
+			p.pos++
+			switch e {
+			case 'b':
+				out = append(out, '\b')
+			case 't':
+				out = append(out, '\t')
+			case 'v':
+				out = append(out, '\v')
+			case 'n':
+				out = append(out, '\n')
+			case 'f':
+				out = append(out, '\f')
+			case 'r':
+				out = append(out, '\r')
+			case '\n', '\r':
+				// line continuation
+			case 'x':
+				if p.pos+2 > len(p.data) {
+					return nil, errors.New("truncated hex escape in quoted string")
+				}
+				v, err := strconv.ParseUint(string(p.data[p.pos:p.pos+2]), 16, 8)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, byte(v))
+				p.pos += 2
+			default:
+				if e >= '0' && e <= '7' && p.pos+2 <= len(p.data) {
+					v, err := strconv.ParseUint(string(p.data[p.pos-1:p.pos+2]), 8, 8)
+					if err != nil {
+						return nil, err
+					}
+					out = append(out, byte(v))
+					p.pos += 2
+				} else {
+					out = append(out, e)
+				}
+			}
+		default:
+			out = append(out, c)
+		}
+	}
+	return nil, errors.New("unterminated quoted string")
+}
@@ -0,0 +1,339 @@
+package keymgr
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"math/big"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp/packet"
+	"code.google.com/p/go.crypto/openpgp/s2k"
+)
+
+// Signature subpacket types, RFC 4880 section 5.2.3.1
+const (
+	subpacketCreationTime      = 2
+	subpacketKeyExpiration     = 9
+	subpacketPrefSymmetric     = 11
+	subpacketIssuer            = 16
+	subpacketPrefHash          = 21
+	subpacketPrefCompression   = 22
+	subpacketPrimaryUserId     = 25
+	subpacketKeyFlags          = 27
+	subpacketRevocationReason  = 29
+	subpacketFeatures          = 30
+	subpacketEmbeddedSignature = 32
+	subpacketIssuerFingerprint = 33
+)
+
+// Key flags, RFC 4880 section 5.2.3.21
+const (
+	keyFlagCertify               = 0x01
+	keyFlagSign                  = 0x02
+	keyFlagEncryptCommunications = 0x04
+	keyFlagEncryptStorage        = 0x08
+	keyFlagAuthenticate          = 0x20
+)
+
+// sigTypeCertificationRevocation revokes a user id certification, RFC 4880
+// section 5.2.1. The openpgp package has no name for it.
+const sigTypeCertificationRevocation packet.SignatureType = 0x30
+
+// featureMDC announces support for modification detection codes, RFC 4880
+// section 5.2.3.24
+const featureMDC = 0x01
+
+type subpacket struct {
+	typ      byte
+	critical bool
+	data     []byte
+}
+
+// signatureBuilder creates version 4 signatures with any subpackets,
+// including the ones packet.Signature cannot write such as embedded
+// signatures and features. The signatures are parsed back into a
+// packet.Signature, which serializes them unchanged.
+type signatureBuilder struct {
+	sigType packet.SignatureType
+	hash    crypto.Hash
+	created time.Time
+	hashed  []subpacket
+}
+
+func newSignatureBuilder(sigType packet.SignatureType, h crypto.Hash, created time.Time) *signatureBuilder {
+	return &signatureBuilder{sigType: sigType, hash: h, created: created}
+}
+
+// add appends a subpacket to the hashed area of the signature.
+func (b *signatureBuilder) add(typ byte, data ...byte) {
+	b.hashed = append(b.hashed, subpacket{typ: typ, data: data})
+}
+
+func (b *signatureBuilder) addUint32(typ byte, v uint32) {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, v)
+	b.add(typ, data...)
+}
+
+var errLifetimeTooLong = fmt.Errorf("lifetime is longer than %d seconds", uint32(math.MaxUint32))
+var errNegativeLifetime = errors.New("lifetime is negative")
+
+// checkLifetime returns an error if d cannot be stored in an expiration
+// subpacket, which holds a number of seconds in 32 bits.
+func checkLifetime(d time.Duration) error {
+	if d < 0 {
+		return errNegativeLifetime
+	}
+	if d/time.Second > math.MaxUint32 {
+		return errLifetimeTooLong
+	}
+	return nil
+}
+
+// addLifetime adds a key or signature expiration subpacket for d after the
+// creation of the key or signature. Nothing is added for a zero duration,
+// d must have been checked with checkLifetime.
+func (b *signatureBuilder) addLifetime(typ byte, d time.Duration) {
+	if secs := int64(d / time.Second); secs > 0 {
+		b.addUint32(typ, uint32(secs))
+	}
+}
+
+// signUserId certifies the binding of id to pub.
+func (b *signatureBuilder) signUserId(id string, pub *packet.PublicKey, signer *packet.PrivateKey, rand io.Reader) (*packet.Signature, error) {
+	h := b.hash.New()
+	if err := hashKey(h, pub); err != nil {
+		return nil, err
+	}
+	var prefix [5]byte
+	prefix[0] = 0xb4
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(id)))
+	h.Write(prefix[:])
+	h.Write([]byte(id))
+	return b.sign(h, signer, rand)
+}
+
+// signUserAttribute certifies the binding of the user attribute with the
+// given packet body to pub.
+func (b *signatureBuilder) signUserAttribute(body []byte, pub *packet.PublicKey, signer *packet.PrivateKey, rand io.Reader) (*packet.Signature, error) {
+	h := b.hash.New()
+	if err := hashKey(h, pub); err != nil {
+		return nil, err
+	}
+	hashUserAttribute(h, body)
+	return b.sign(h, signer, rand)
+}
+
+// signKey signs the binding of subkey to pub, or with a signature type of
+// packet.SigTypePrimaryKeyBinding the back signature made by the subkey.
+func (b *signatureBuilder) signKey(pub, subkey *packet.PublicKey, signer *packet.PrivateKey, rand io.Reader) (*packet.Signature, error) {
+	body, err := b.signKeyBody(pub, subkey, signer, rand)
+	if err != nil {
+		return nil, err
+	}
+	return parseSignatureBody(body)
+}
+
+func (b *signatureBuilder) signKeyBody(pub, subkey *packet.PublicKey, signer *packet.PrivateKey, rand io.Reader) ([]byte, error) {
+	h := b.hash.New()
+	if err := hashKey(h, pub); err != nil {
+		return nil, err
+	}
+	if err := hashKey(h, subkey); err != nil {
+		return nil, err
+	}
+	return b.signBody(h, signer, rand)
+}
+
+// signDirect makes a signature over pub alone, such as a key revocation.
+func (b *signatureBuilder) signDirect(pub *packet.PublicKey, signer *packet.PrivateKey, rand io.Reader) (*packet.Signature, error) {
+	h := b.hash.New()
+	if err := hashKey(h, pub); err != nil {
+		return nil, err
+	}
+	return b.sign(h, signer, rand)
+}
+
+func (b *signatureBuilder) sign(h hash.Hash, signer *packet.PrivateKey, rand io.Reader) (*packet.Signature, error) {
+	body, err := b.signBody(h, signer, rand)
+	if err != nil {
+		return nil, err
+	}
+	return parseSignatureBody(body)
+}
+
+// signBody completes the hash h of the signed data and returns the body
+// of the signature packet. The creation time and issuer subpackets are
+// added here.
+func (b *signatureBuilder) signBody(h hash.Hash, signer *packet.PrivateKey, rand io.Reader) ([]byte, error) {
+	if signer.Encrypted {
+		return nil, errLockedKey
+	}
+	hashId, ok := s2k.HashToHashId(b.hash)
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function %v", b.hash)
+	}
+	issuer := make([]byte, 8)
+	binary.BigEndian.PutUint64(issuer, signer.KeyId)
+	hashed := append([]subpacket{
+		{typ: subpacketCreationTime, data: unixTime(b.created)},
+		{typ: subpacketIssuerFingerprint, data: append([]byte{4}, signer.Fingerprint[:]...)},
+	}, b.hashed...)
+	unhashed := []subpacket{{typ: subpacketIssuer, data: issuer}}
+
+	body := &bytes.Buffer{}
+	body.Write([]byte{4, byte(b.sigType), byte(signer.PubKeyAlgo), hashId})
+	writeSubpackets(body, hashed)
+	hashedLen := body.Len()
+	h.Write(body.Bytes())
+	trailer := []byte{4, 0xff, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(trailer[2:], uint32(hashedLen))
+	h.Write(trailer)
+	digest := h.Sum(nil)
+
+	writeSubpackets(body, unhashed)
+	body.Write(digest[:2])
+	mpis, err := signDigest(digest, b.hash, signer, rand)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range mpis {
+		writeMPI(body, v)
+	}
+	return body.Bytes(), nil
+}
+
+func signDigest(digest []byte, h crypto.Hash, signer *packet.PrivateKey, rand io.Reader) ([]*big.Int, error) {
+	switch priv := signer.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		sig, err := rsa.SignPKCS1v15(rand, priv, h, digest)
+		if err != nil {
+			return nil, err
+		}
+		return []*big.Int{new(big.Int).SetBytes(sig)}, nil
+	case *dsa.PrivateKey:
+		// FIPS 186-3, section 4.6: use the leftmost bits of the digest
+		n := priv.Q.BitLen() / 8
+		if n < len(digest) {
+			digest = digest[:n]
+		}
+		r, s, err := dsa.Sign(rand, priv, digest)
+		if err != nil {
+			return nil, err
+		}
+		return []*big.Int{r, s}, nil
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand, priv, digest)
+		if err != nil {
+			return nil, err
+		}
+		return []*big.Int{r, s}, nil
+	}
+	return nil, errors.New("secret key cannot make signatures")
+}
+
+func parseSignatureBody(body []byte) (*packet.Signature, error) {
+	b := &bytes.Buffer{}
+	if err := writePacket(b, tagSignature, body); err != nil {
+		return nil, err
+	}
+	p, err := packet.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok {
+		return nil, errors.New("not a signature packet")
+	}
+	return sig, nil
+}
+
+// hashKey writes the key prefix of the data covered by a key signature,
+// RFC 4880 section 5.2.4.
+func hashKey(h hash.Hash, pk *packet.PublicKey) error {
+	body, err := publicKeyBody(pk)
+	if err != nil {
+		return err
+	}
+	h.Write([]byte{0x99, byte(len(body) >> 8), byte(len(body))})
+	h.Write(body)
+	return nil
+}
+
+// hashedSubpacket returns the data of the first hashed subpacket of the
+// given type in the version 4 signature sig, or nil if there is none.
+func hashedSubpacket(sig *packet.Signature, typ byte) []byte {
+	suffix := sig.HashSuffix
+	if len(suffix) < 6 || suffix[0] != 4 {
+		return nil
+	}
+	n := int(suffix[4])<<8 | int(suffix[5])
+	if 6+n > len(suffix) {
+		return nil
+	}
+	for sps := suffix[6 : 6+n]; len(sps) > 0; {
+		var length, hlen int
+		switch {
+		case sps[0] < 192:
+			hlen, length = 1, int(sps[0])
+		case sps[0] < 255 && len(sps) >= 2:
+			hlen, length = 2, (int(sps[0])-192)<<8+int(sps[1])+192
+		case sps[0] == 255 && len(sps) >= 5:
+			hlen, length = 5, int(binary.BigEndian.Uint32(sps[1:]))
+		default:
+			return nil
+		}
+		if length < 1 || hlen+length > len(sps) {
+			return nil
+		}
+		if sps[hlen]&0x7f == typ {
+			return sps[hlen+1 : hlen+length]
+		}
+		sps = sps[hlen+length:]
+	}
+	return nil
+}
+
+func writeSubpackets(w *bytes.Buffer, sps []subpacket) {
+	data := &bytes.Buffer{}
+	for _, sp := range sps {
+		n := len(sp.data) + 1
+		switch {
+		case n < 192:
+			data.WriteByte(byte(n))
+		case n < 8384:
+			n -= 192
+			data.Write([]byte{byte(192 + n>>8), byte(n)})
+		default:
+			data.Write([]byte{255, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+		}
+		typ := sp.typ
+		if sp.critical {
+			typ |= 0x80
+		}
+		data.WriteByte(typ)
+		data.Write(sp.data)
+	}
+	w.Write([]byte{byte(data.Len() >> 8), byte(data.Len())})
+	w.Write(data.Bytes())
+}
+
+func writeMPI(w *bytes.Buffer, v *big.Int) {
+	w.Write([]byte{byte(v.BitLen() >> 8), byte(v.BitLen())})
+	w.Write(v.Bytes())
+}
+
+func unixTime(t time.Time) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	return b
+}
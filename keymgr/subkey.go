@@ -0,0 +1,187 @@
+package keymgr
+
+import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+// Subkey usages for AddSubkey
+const (
+	SubkeySign         = "sign"
+	SubkeyEncrypt      = "encrypt"
+	SubkeyAuthenticate = "authenticate"
+)
+
+var subkeyFlags = map[string]byte{
+	SubkeySign:         keyFlagSign,
+	SubkeyEncrypt:      keyFlagEncryptCommunications | keyFlagEncryptStorage,
+	SubkeyAuthenticate: keyFlagAuthenticate,
+}
+
+var errNoEncryptionSubkey = errors.New("key has no valid encryption subkey")
+var errNegativeOverlap = errors.New("rotation overlap must not be negative")
+
+// AddSubkey adds a new subkey for usage, one of SubkeySign, SubkeyEncrypt
+// or SubkeyAuthenticate, to the key with the given fingerprint, which must
+// be in the nyms secret keyring. The algorithm, size and lifetime of the
+// subkey are taken from params, encryption subkeys must be RSA keys. If
+// the secret key is protected the subkey is protected with passphrase as
+// well. The changed secret key is returned.
+func AddSubkey(fingerprint [20]byte, usage string, params *KeyParams, passphrase []byte) (*openpgp.Entity, error) {
+	return addSubkey(fingerprint, usage, params, passphrase, 0, false)
+}
+
+// DefaultRotationOverlap is how long the old encryption subkeys stay valid
+// after a rotation unless another overlap is given, time for
+// correspondents to refresh the key before they can no longer encrypt to
+// it.
+const DefaultRotationOverlap = 30 * 24 * time.Hour
+
+// RotateEncryptionSubkey adds a new encryption subkey to the key with the
+// given fingerprint like AddSubkey and sets the current encryption subkeys
+// to expire after overlap, unless they expire earlier. Correspondents
+// holding the old public key can encrypt to the old subkeys until then,
+// while the new subkey is used by those who have the rotated key. The old
+// subkeys are kept so that messages encrypted to them can still be
+// decrypted.
+func RotateEncryptionSubkey(fingerprint [20]byte, params *KeyParams, overlap time.Duration, passphrase []byte) (*openpgp.Entity, error) {
+	if overlap < 0 {
+		return nil, errNegativeOverlap
+	}
+	return addSubkey(fingerprint, SubkeyEncrypt, params, passphrase, overlap, true)
+}
+
+func addSubkey(fingerprint [20]byte, usage string, params *KeyParams, passphrase []byte, overlap time.Duration, rotate bool) (*openpgp.Entity, error) {
+	flags, ok := subkeyFlags[strings.ToLower(usage)]
+	if !ok {
+		return nil, fmt.Errorf("unknown subkey usage %q", usage)
+	}
+	if params == nil {
+		params = &KeyParams{}
+	}
+	if err := checkLifetime(params.Lifetime); err != nil {
+		return nil, err
+	}
+	return changeKey(fingerprint, passphrase, func(e *openpgp.Entity, x *keyExtras, signer *packet.PrivateKey) (func(*openpgp.Entity, *keyExtras), error) {
+		protected := e.PrivateKey.Encrypted || x.protectedPacket(e.PrivateKey.Fingerprint) != nil
+		if protected && !e.PrivateKey.Encrypted {
+			// the key was unlocked before, so passphrase has not been
+			// checked yet
+			if _, err := unlockedKey(e.PrivateKey, x, passphrase); err != nil {
+				return nil, err
+			}
+		}
+		h := signatureHash(selfSignatureTemplate(e))
+		now := time.Now()
+		created := now
+		var expired []openpgp.Subkey
+		if rotate {
+			expires := now.Add(overlap)
+			found := false
+			for _, sk := range e.Subkeys {
+				if !isEncryptionSubkey(sk, now) {
+					continue
+				}
+				found = true
+				if end := expirationTime(sk.PublicKey, sk.Sig); end.IsZero() || end.After(expires) {
+					sig, err := expireSubkey(e.PrimaryKey, sk, signer, h, now, expires, rand.Reader)
+					if err != nil {
+						return nil, err
+					}
+					sk.Sig = sig
+					expired = append(expired, sk)
+				}
+				// the newest binding decides which subkey is used
+				if !created.After(sk.Sig.CreationTime) {
+					created = sk.Sig.CreationTime.Add(time.Second)
+				}
+			}
+			if !found {
+				return nil, errNoEncryptionSubkey
+			}
+		}
+		priv, err := newSubkey(flags, params, nil)
+		if err != nil {
+			return nil, err
+		}
+		primary := &openpgp.Entity{PrimaryKey: e.PrimaryKey, PrivateKey: signer}
+		sk, err := bindSubkey(primary, priv, flags, params.Lifetime, h, created, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		var pkt []byte
+		if protected {
+			var locked *packet.PrivateKey
+			if locked, pkt, err = protectKey(priv, passphrase, rand.Reader); err != nil {
+				return nil, err
+			}
+			if e.PrivateKey.Encrypted {
+				sk.PrivateKey = locked
+			}
+		}
+		return func(c *openpgp.Entity, cx *keyExtras) {
+			for _, x := range expired {
+				if i := findSubkey(c.Subkeys, x.PublicKey.Fingerprint); i >= 0 {
+					c.Subkeys[i].Sig = x.Sig
+				}
+			}
+			n := sk
+			if c.PrivateKey == nil {
+				n.PrivateKey = nil
+			} else if pkt != nil {
+				cx.setProtected(priv.Fingerprint, pkt)
+			}
+			c.Subkeys = append(c.Subkeys, n)
+		}, nil
+	})
+}
+
+// newSubkey generates the key for a new subkey with the given key flags.
+func newSubkey(flags byte, params *KeyParams, config *packet.Config) (*packet.PrivateKey, error) {
+	if flags&keyFlagEncryptCommunications == 0 {
+		return params.newSigningKey(config)
+	}
+	if a := strings.ToLower(params.Algorithm); a != "" && a != "rsa" {
+		return nil, fmt.Errorf("unsupported encryption key algorithm %q", params.Algorithm)
+	}
+	return newRSAKey(params, config)
+}
+
+// isEncryptionSubkey reports whether sk is a subkey which is only used for
+// encryption and is neither revoked nor expired.
+func isEncryptionSubkey(sk openpgp.Subkey, now time.Time) bool {
+	sig := sk.Sig
+	return sig.SigType == packet.SigTypeSubkeyBinding && sig.FlagsValid &&
+		(sig.FlagEncryptCommunications || sig.FlagEncryptStorage) && !sig.FlagSign &&
+		!subkeyExpired(sk, now)
+}
+
+// subkeyExpired reports whether the key expiration time of sk, which is
+// counted from the creation of the subkey, has passed.
+func subkeyExpired(sk openpgp.Subkey, now time.Time) bool {
+	expires := expirationTime(sk.PublicKey, sk.Sig)
+	return !expires.IsZero() && now.After(expires)
+}
+
+// expireSubkey signs a new binding for sk which lets it expire at expires.
+// The binding is dated a second before now where possible so that the
+// binding of a subkey added at now is newer.
+func expireSubkey(pub *packet.PublicKey, sk openpgp.Subkey, signer *packet.PrivateKey, h crypto.Hash, now, expires time.Time, rand io.Reader) (*packet.Signature, error) {
+	created := now.Add(-time.Second)
+	if !created.After(sk.Sig.CreationTime) {
+		created = sk.Sig.CreationTime.Add(time.Second)
+	}
+	lifetime := keyLifetime(sk.PublicKey, expires)
+	if err := checkLifetime(lifetime); err != nil {
+		return nil, err
+	}
+	return rebindSubkey(pub, sk, signer, h, created, lifetime, rand)
+}
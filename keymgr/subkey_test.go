@@ -0,0 +1,122 @@
+package keymgr
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+func TestAddSubkey(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	params := &KeyParams{Bits: 1024, Passphrase: []byte("password")}
+	e, err := generateNewKey("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+
+	if _, err := AddSubkey(fp, "certify", nil, []byte("password")); err == nil {
+		t.Error("adding subkey with unknown usage succeeded")
+	}
+	if _, err := AddSubkey(fp, SubkeyEncrypt, &KeyParams{Algorithm: "ecdsa"}, []byte("password")); err == nil {
+		t.Error("adding ECDSA encryption subkey succeeded")
+	}
+	if _, err := AddSubkey(fp, SubkeySign, nil, []byte("wrong")); err != errWrongPassphrase {
+		t.Errorf("adding subkey with wrong passphrase returned %v", err)
+	}
+	sub := &KeyParams{Algorithm: "ecdsa", Lifetime: time.Hour}
+	k, err := AddSubkey(fp, SubkeySign, sub, []byte("password"))
+	if err != nil {
+		t.Fatalf("error adding subkey: %v", err)
+	}
+	if len(k.Subkeys) != 2 || k.Subkeys[1].PrivateKey == nil {
+		t.Fatal("subkey not added to secret key")
+	}
+	sk := k.Subkeys[1]
+	if sk.PublicKey.PubKeyAlgo != packet.PubKeyAlgoECDSA || !sk.Sig.FlagSign || sk.Sig.KeyLifetimeSecs == nil || *sk.Sig.KeyLifetimeSecs != 3600 {
+		t.Error("added subkey does not have the requested algorithm, usage and expiration")
+	}
+
+	s := storedSecretKey(t)
+	if len(s.Subkeys) != 2 {
+		t.Fatalf("expecting 2 stored subkeys, got %d", len(s.Subkeys))
+	}
+	if err := s.Subkeys[1].PrivateKey.Decrypt([]byte("password")); err != nil {
+		t.Errorf("added subkey is not protected with the passphrase: %v", err)
+	}
+
+	// the passphrase is checked for a key which was unlocked before
+	if ok, _ := UnlockPrivateKey(KeySource().GetSecretKeyById(e.PrimaryKey.KeyId), []byte("password")); !ok {
+		t.Fatal("error unlocking key")
+	}
+	if _, err := AddSubkey(fp, SubkeySign, sub, []byte("wrong")); err != errWrongPassphrase {
+		t.Errorf("adding subkey to unlocked key with wrong passphrase returned %v", err)
+	}
+}
+
+func TestRotateEncryptionSubkey(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	e, err := generateNewKey("foo", "", "foo@bar.com", &KeyParams{Bits: 1024}, nil)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+	oldId := e.Subkeys[0].PublicKey.KeyId
+	old := &bytes.Buffer{}
+	w, err := openpgp.Encrypt(old, openpgp.EntityList{e}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("old"))
+	w.Close()
+
+	if _, err := RotateEncryptionSubkey(fp, nil, -time.Hour, nil); err != errNegativeOverlap {
+		t.Errorf("rotating with a negative overlap returned %v", err)
+	}
+	k, err := RotateEncryptionSubkey(fp, &KeyParams{Bits: 1024}, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("error rotating subkey: %v", err)
+	}
+	if len(k.Subkeys) != 2 {
+		t.Fatalf("expecting 2 subkeys after rotation, got %d", len(k.Subkeys))
+	}
+	if !isEncryptionSubkey(k.Subkeys[0], time.Now().Add(time.Minute)) {
+		t.Error("old encryption subkey expired before the end of the overlap")
+	}
+	if !subkeyExpired(k.Subkeys[0], time.Now().Add(2*time.Hour)) {
+		t.Error("old encryption subkey does not expire after the overlap")
+	}
+	newId := k.Subkeys[1].PublicKey.KeyId
+
+	sec := KeySource().GetSecretKeyById(e.PrimaryKey.KeyId)
+	for _, msg := range []*bytes.Buffer{old, encryptTo(t, k)} {
+		md, err := openpgp.ReadMessage(msg, openpgp.EntityList{sec}, nil, nil)
+		if err != nil {
+			t.Fatalf("error decrypting after rotation: %v", err)
+		}
+		if _, err := ioutil.ReadAll(md.UnverifiedBody); err != nil {
+			t.Fatal(err)
+		}
+		if msg != old && md.EncryptedToKeyIds[0] != newId {
+			t.Error("message not encrypted to the new subkey")
+		}
+		if msg == old && md.EncryptedToKeyIds[0] != oldId {
+			t.Error("old message not encrypted to the old subkey")
+		}
+	}
+}
+
+func encryptTo(t *testing.T, e *openpgp.Entity) *bytes.Buffer {
+	b := &bytes.Buffer{}
+	w, err := openpgp.Encrypt(b, openpgp.EntityList{e}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("new"))
+	w.Close()
+	return b
+}
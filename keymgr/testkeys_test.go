@@ -1,9 +1,12 @@
 package keymgr
 
 import (
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"os"
 	"strings"
+	"testing"
 	"time"
 
 	"github.com/nymsio/pgpmail"
@@ -36,9 +39,26 @@ func openpgpTestConfig() *packet.Config {
 	return &packet.Config{Rand: testRand, Time: testTime}
 }
 
+// useTempNymsDirectory points the nyms directory and the default key store
+// at a new temporary directory and returns a function restoring them.
+func useTempNymsDirectory(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "nyms-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDirectory, oldKeys := nymsDirectory, defaultKeys
+	nymsDirectory, defaultKeys = dir, newKeyStore()
+	return func() {
+		nymsDirectory, defaultKeys = oldDirectory, oldKeys
+		os.RemoveAll(dir)
+	}
+}
+
 func testKeySource() pgpmail.KeySource {
 	pub, sec := loadTestKeyring()
-	return &keyStore{publicKeys: pub, secretKeys: sec}
+	store := &keyStore{nyms: keyring{public: pub, secret: sec}}
+	store.rebuild()
+	return store
 }
 
 func loadTestKeyring() (pub, sec openpgp.EntityList) {
@@ -0,0 +1,145 @@
+package keymgr
+
+import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+	"code.google.com/p/go.crypto/openpgp/packet"
+)
+
+var errInvalidUserId = errors.New("invalid user id")
+var errUserIdExists = errors.New("user id already exists")
+var errUserIdRevoked = errors.New("user id is revoked")
+
+// AddUserId adds a user id to the key with the given fingerprint, which
+// must be in the nyms secret keyring, self signed with the key flags,
+// expiration and preferences of its primary user id. If the secret key is
+// locked it is unlocked with passphrase. The changed secret key is
+// returned.
+func AddUserId(fingerprint [20]byte, name, comment, email string, passphrase []byte) (*openpgp.Entity, error) {
+	uid := packet.NewUserId(name, comment, email)
+	if uid == nil {
+		return nil, errInvalidUserId
+	}
+	return changeKey(fingerprint, passphrase, func(e *openpgp.Entity, x *keyExtras, signer *packet.PrivateKey) (func(*openpgp.Entity, *keyExtras), error) {
+		if _, ok := e.Identities[uid.Id]; ok {
+			return nil, errUserIdExists
+		}
+		template := selfSignatureTemplate(e)
+		b := newSelfSignatureBuilder(template, time.Now(), false, signatureLifetime(template))
+		sig, err := b.signUserId(uid.Id, e.PrimaryKey, signer, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return func(c *openpgp.Entity, _ *keyExtras) {
+			c.Identities[uid.Id] = &openpgp.Identity{Name: uid.Id, UserId: uid, SelfSignature: sig}
+		}, nil
+	})
+}
+
+// SetPrimaryUserId marks the user id of the key with the given fingerprint
+// as primary like AddUserId, signing the user ids whose primary flag
+// changes again.
+func SetPrimaryUserId(fingerprint [20]byte, id string, passphrase []byte) (*openpgp.Entity, error) {
+	return changeKey(fingerprint, passphrase, func(e *openpgp.Entity, x *keyExtras, signer *packet.PrivateKey) (func(*openpgp.Entity, *keyExtras), error) {
+		ident, ok := e.Identities[id]
+		if !ok {
+			return nil, errUserIdNotFound
+		}
+		if isUserIdRevoked(e, id, ident) {
+			return nil, errUserIdRevoked
+		}
+		sigs := make(map[string]*packet.Signature)
+		for name, ident := range e.Identities {
+			primary := name == id
+			if isPrimaryIdentity(ident) == primary {
+				continue
+			}
+			b := newSelfSignatureBuilder(ident.SelfSignature, time.Now(), primary, signatureLifetime(ident.SelfSignature))
+			sig, err := b.signUserId(name, e.PrimaryKey, signer, rand.Reader)
+			if err != nil {
+				return nil, err
+			}
+			sigs[name] = sig
+		}
+		return func(c *openpgp.Entity, _ *keyExtras) {
+			for name, sig := range sigs {
+				if ident, ok := c.Identities[name]; ok {
+					ident.SelfSignature = sig
+				}
+			}
+		}, nil
+	})
+}
+
+// newSelfSignatureBuilder returns a builder for a user id self signature
+// with the key flags and preferences of template and the given key
+// lifetime. The creation time is moved past the one of template so that
+// the new signature supersedes it.
+func newSelfSignatureBuilder(template *packet.Signature, created time.Time, primary bool, lifetime time.Duration) *signatureBuilder {
+	if !created.After(template.CreationTime) {
+		created = template.CreationTime.Add(time.Second)
+	}
+	b := newSignatureBuilder(packet.SigTypePositiveCert, signatureHash(template), created)
+	if template.FlagsValid {
+		b.add(subpacketKeyFlags, signatureKeyFlags(template))
+	}
+	b.addLifetime(subpacketKeyExpiration, lifetime)
+	if len(template.PreferredSymmetric) > 0 {
+		b.add(subpacketPrefSymmetric, template.PreferredSymmetric...)
+	}
+	if len(template.PreferredHash) > 0 {
+		b.add(subpacketPrefHash, template.PreferredHash...)
+	}
+	if len(template.PreferredCompression) > 0 {
+		b.add(subpacketPrefCompression, template.PreferredCompression...)
+	}
+	if template.MDC {
+		b.add(subpacketFeatures, featureMDC)
+	}
+	if primary {
+		b.add(subpacketPrimaryUserId, 1)
+	}
+	return b
+}
+
+// selfSignatureTemplate returns the self signature whose key flags and
+// preferences new self signatures of e copy, the one of the primary
+// identity or of any user id if they are all revoked.
+func selfSignatureTemplate(e *openpgp.Entity) *packet.Signature {
+	if sig := primarySelfSignature(e); sig != nil {
+		return sig
+	}
+	return sortedIdentities(e)[0].SelfSignature
+}
+
+// signatureHash returns the hash function of sig for making a signature
+// which replaces it, avoiding SHA-1.
+func signatureHash(sig *packet.Signature) crypto.Hash {
+	if sig.Hash == crypto.SHA1 || !sig.Hash.Available() {
+		return crypto.SHA256
+	}
+	return sig.Hash
+}
+
+// signatureKeyFlags returns the first byte of the key flags of sig. The
+// flags are read from the hashed subpackets since the openpgp package
+// drops the ones it does not know, such as authentication.
+func signatureKeyFlags(sig *packet.Signature) byte {
+	if data := hashedSubpacket(sig, subpacketKeyFlags); len(data) > 0 {
+		return data[0]
+	}
+	return 0
+}
+
+// signatureLifetime returns the key lifetime given by sig, zero if the key
+// does not expire.
+func signatureLifetime(sig *packet.Signature) time.Duration {
+	if sig == nil || sig.KeyLifetimeSecs == nil {
+		return 0
+	}
+	return time.Duration(*sig.KeyLifetimeSecs) * time.Second
+}
@@ -0,0 +1,64 @@
+package keymgr
+
+import (
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/openpgp"
+)
+
+func TestManageUserIds(t *testing.T) {
+	defer useTempNymsDirectory(t)()
+	params := &KeyParams{Bits: 1024, Lifetime: 24 * 365 * time.Hour, Passphrase: []byte("password")}
+	e, err := generateNewKey("foo", "", "foo@bar.com", params, nil)
+	if err != nil {
+		t.Fatalf("error generating key %v", err)
+	}
+	fp := e.PrimaryKey.Fingerprint
+	oldId := "foo <foo@bar.com>"
+
+	if _, err := AddUserId(fp, "foo", "", "foo@bar.com", []byte("password")); err != errUserIdExists {
+		t.Errorf("adding existing user id returned %v", err)
+	}
+	if _, err := AddUserId(fp, "foo", "", "foo@baz.com", []byte("wrong")); err != errWrongPassphrase {
+		t.Errorf("adding user id with wrong passphrase returned %v", err)
+	}
+	k, err := AddUserId(fp, "foo", "work", "Foo@Baz.com", []byte("password"))
+	if err != nil {
+		t.Fatalf("error adding user id: %v", err)
+	}
+	newId := "foo (work) <Foo@Baz.com>"
+	sig := k.Identities[newId].SelfSignature
+	if sig == nil || isPrimaryIdentity(k.Identities[newId]) {
+		t.Fatal("added user id is missing or primary")
+	}
+	if sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs != uint32(params.Lifetime/time.Second) || !sig.FlagSign {
+		t.Error("added user id does not carry the key flags and expiration of the primary user id")
+	}
+	if k, _ := KeySource().GetSecretKey("foo@baz.com"); k == nil || k.PrimaryKey.Fingerprint != fp {
+		t.Error("key not found by added address")
+	}
+
+	if _, err := SetPrimaryUserId(fp, newId, []byte("password")); err != nil {
+		t.Fatalf("error setting primary user id: %v", err)
+	}
+	nyms, _, _ := loadKeyrings()
+	for _, k := range []*openpgp.Entity{nyms.public[0], nyms.secret[0]} {
+		if len(k.Identities) != 2 {
+			t.Fatalf("expecting 2 stored user ids, got %d", len(k.Identities))
+		}
+		if !isPrimaryIdentity(k.Identities[newId]) || isPrimaryIdentity(k.Identities[oldId]) {
+			t.Error("primary user id not changed in stored key")
+		}
+	}
+
+	if _, err := RevokeUserId(fp, oldId, ReasonUserIdInvalid, "", []byte("password")); err != nil {
+		t.Fatalf("error revoking user id: %v", err)
+	}
+	if k, _ := KeySource().GetPublicKey("foo@bar.com"); k != nil {
+		t.Error("key still found by revoked address")
+	}
+	if _, err := SetPrimaryUserId(fp, oldId, []byte("password")); err != errUserIdRevoked {
+		t.Errorf("setting revoked user id as primary returned %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package keymgr
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadDelay is how long to wait after a keyring file changes before
+// reloading, so that a burst of writes only causes a single reload.
+const reloadDelay = 500 * time.Millisecond
+
+// WatchKeyrings starts watching the nyms and GnuPG keyring files and
+// reloads the default key store whenever they change.
+func WatchKeyrings() error {
+	dirs := []string{nymsDirectory}
+	if home, err := gnupgHome(); err == nil {
+		dirs = append(dirs, home, filepath.Join(home, privateKeysDirectory))
+	}
+	changes, err := watchDirectories(dirs, nil)
+	if err != nil {
+		return err
+	}
+	go reloadOnChange(changes)
+	return nil
+}
+
+// reloadOnChange reloads the default key store once the keyring files
+// reported by changes have settled. Files written by the agent itself are
+// already reflected in the key store, so they do not cause a reload.
+func reloadOnChange(changes <-chan string) {
+	var timer <-chan time.Time
+	changed := make(map[string]bool)
+	for {
+		select {
+		case path, ok := <-changes:
+			if !ok {
+				logger.Warning("Stopped watching keyring files")
+				return
+			}
+			if !isKeyringFile(path) {
+				continue
+			}
+			changed[path] = true
+			if timer == nil {
+				timer = time.After(reloadDelay)
+			}
+		case <-timer:
+			timer = nil
+			external := false
+			for path := range changed {
+				if !ownWrites.isOwn(path) {
+					external = true
+				}
+			}
+			changed = make(map[string]bool)
+			if !external {
+				continue
+			}
+			logger.Info("Keyring files changed, reloading")
+			if err := reloadDefaultKeyring(); err != nil {
+				logger.Warningf("Error reloading keyrings, keeping current keys: %v", err)
+			}
+		}
+	}
+}
+
+func isKeyringFile(path string) bool {
+	switch filepath.Base(path) {
+	case publicKeyringFilename, secretKeyringFilename, pubring, secring, keybox:
+		return true
+	}
+	return filepath.Base(filepath.Dir(path)) == privateKeysDirectory && strings.HasSuffix(path, ".key")
+}
+
+// ownWrites records the files written by the agent itself.
+var ownWrites = &writeLog{files: make(map[string]os.FileInfo)}
+
+// writeLog holds the state of files right after they were written, which
+// tells a later change by another program from the write itself.
+type writeLog struct {
+	sync.Mutex
+	files map[string]os.FileInfo
+}
+
+// record notes the current state of the file at path as written by the
+// agent.
+func (l *writeLog) record(path string) {
+	path = filepath.Clean(path)
+	fi, err := os.Stat(path)
+	l.Lock()
+	defer l.Unlock()
+	if err != nil {
+		delete(l.files, path)
+		return
+	}
+	l.files[path] = fi
+}
+
+// isOwn returns true if the file at path is the one last written by the
+// agent and has not been changed since.
+func (l *writeLog) isOwn(path string) bool {
+	path = filepath.Clean(path)
+	l.Lock()
+	fi, ok := l.files[path]
+	l.Unlock()
+	if !ok {
+		return false
+	}
+	cur, err := os.Stat(path)
+	return err == nil && os.SameFile(fi, cur) && cur.Size() == fi.Size() && cur.ModTime().Equal(fi.ModTime())
+}
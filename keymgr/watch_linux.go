@@ -0,0 +1,67 @@
+package keymgr
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_CREATE | syscall.IN_DELETE
+
+// watchDirectories uses inotify to report the paths of files which are
+// written, created, renamed or deleted in any of dirs. Directories which
+// do not exist are ignored. Watching stops once stop is closed, the
+// channel is closed when the next event arrives.
+func watchDirectories(dirs []string, stop <-chan struct{}) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	watches := make(map[int32]string)
+	for _, dir := range dirs {
+		wd, err := syscall.InotifyAddWatch(fd, dir, inotifyMask)
+		if err == nil {
+			watches[int32(wd)] = dir
+		} else if err != syscall.ENOENT {
+			logger.Warningf("Cannot watch %s: %v", dir, err)
+		}
+	}
+	if len(watches) == 0 {
+		syscall.Close(fd)
+		return nil, errors.New("no keyring directories to watch")
+	}
+	ch := make(chan string)
+	go readInotifyEvents(fd, watches, ch, stop)
+	return ch, nil
+}
+
+func readInotifyEvents(fd int, watches map[int32]string, ch chan<- string, stop <-chan struct{}) {
+	defer close(ch)
+	defer syscall.Close(fd)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil || n <= 0 {
+			logger.Warningf("Error reading inotify events: %v", err)
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[start:start+int(ev.Len)]), "\x00")
+			off = start + int(ev.Len)
+			if dir, ok := watches[ev.Wd]; ok && name != "" {
+				select {
+				case ch <- filepath.Join(dir, name):
+				case <-stop:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+//go:build !linux
+// +build !linux
+
+package keymgr
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+const pollInterval = 2 * time.Second
+
+// watchDirectories polls dirs and reports the paths of files whose
+// modification time changed or which were created or deleted. Polling
+// stops and the channel is closed once stop is closed.
+func watchDirectories(dirs []string, stop <-chan struct{}) (<-chan string, error) {
+	ch := make(chan string)
+	go pollDirectories(dirs, ch, stop)
+	return ch, nil
+}
+
+func pollDirectories(dirs []string, ch chan<- string, stop <-chan struct{}) {
+	defer close(ch)
+	last := scanDirectories(dirs)
+	for {
+		select {
+		case <-time.After(pollInterval):
+		case <-stop:
+			return
+		}
+		current := scanDirectories(dirs)
+		var changed []string
+		for path, t := range current {
+			if lt, ok := last[path]; !ok || !lt.Equal(t) {
+				changed = append(changed, path)
+			}
+		}
+		for path := range last {
+			if _, ok := current[path]; !ok {
+				changed = append(changed, path)
+			}
+		}
+		for _, path := range changed {
+			select {
+			case ch <- path:
+			case <-stop:
+				return
+			}
+		}
+		last = current
+	}
+}
+
+func scanDirectories(dirs []string) map[string]time.Time {
+	result := make(map[string]time.Time)
+	for _, dir := range dirs {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			result[filepath.Join(dir, fi.Name())] = fi.ModTime()
+		}
+	}
+	return result
+}
@@ -0,0 +1,73 @@
+package keymgr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyms-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stop := make(chan struct{})
+	defer close(stop)
+	changes, err := watchDirectories([]string{dir}, stop)
+	if err != nil {
+		t.Fatalf("error watching directory: %v", err)
+	}
+	path := filepath.Join(dir, publicKeyringFilename)
+	if err := ioutil.WriteFile(path, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-changes:
+		if p != path {
+			t.Errorf("expecting change to %s, got %s", path, p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no change reported after writing keyring file")
+	}
+}
+
+func TestOwnWritesAreRecognized(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nyms-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, publicKeyringFilename)
+	if ownWrites.isOwn(path) {
+		t.Error("file which was never written reported as own write")
+	}
+	if err := writeFileAtomic(path, []byte("keys"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !ownWrites.isOwn(path) {
+		t.Error("file written by writeFileAtomic not reported as own write")
+	}
+	if err := ioutil.WriteFile(path, []byte("other keys"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ownWrites.isOwn(path) {
+		t.Error("file changed by another writer reported as own write")
+	}
+}
+
+func TestIsKeyringFile(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"/home/u/.nyms/nymskeys.pub":              true,
+		"/home/u/.gnupg/pubring.kbx":              true,
+		"/home/u/.gnupg/private-keys-v1.d/AB.key": true,
+		"/home/u/.gnupg/trustdb.gpg":              false,
+		"/home/u/.nyms/log":                       false,
+	} {
+		if isKeyringFile(path) != expected {
+			t.Errorf("isKeyringFile(%q) != %v", path, expected)
+		}
+	}
+}
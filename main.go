@@ -15,17 +15,35 @@ import (
 
 var pipe bool
 var protoDebug bool
+var compact bool
+var subaddress bool
 
 func init() {
 	flag.BoolVar(&pipe, "pipe", false, "Run RPC service on stdin/stdout")
 	flag.BoolVar(&protoDebug, "debug", false, "Log RPC traffic")
+	flag.BoolVar(&compact, "compact", false, "Compact the nyms keyring files on startup")
+	flag.BoolVar(&subaddress, "subaddress", false, "Use the keys of user@domain for user+tag@domain")
 	flag.Parse()
 }
 
 func main() {
 	createLogger()
+	keymgr.SetSubaddressMatching(subaddress)
+	if compact {
+		n, err := keymgr.CompactKeyrings()
+		if err != nil {
+			logger.Warning(fmt.Sprintf("Failed to compact keyrings: %s", err))
+		} else {
+			logger.Info(fmt.Sprintf("Compacted keyrings, removed %d packets", n))
+		}
+	}
 	if pipe {
-		keymgr.LoadDefaultKeyring()
+		if err := keymgr.LoadDefaultKeyring(); err != nil {
+			logger.Warning(fmt.Sprintf("Failed to load keyrings: %s", err))
+		}
+		if err := keymgr.WatchKeyrings(); err != nil {
+			logger.Warning(fmt.Sprintf("Failed to watch keyring files: %s", err))
+		}
 		runPipeServer(protoDebug)
 		return
 	}
@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 
@@ -21,10 +22,19 @@ func populateKeyInfo(k *openpgp.Entity, info *GetKeyInfoResult) {
 	info.Fingerprint = hex.EncodeToString(k.PrimaryKey.Fingerprint[:])
 	info.KeyId = encodeKeyId(k.PrimaryKey.KeyId)
 	info.Summary = keymgr.RenderKey(k)
+	if expires := keymgr.KeyExpiration(k); !expires.IsZero() {
+		info.Expires = expires.Unix()
+	}
 
 	for id, _ := range k.Identities {
 		info.UserIDs = append(info.UserIDs, id)
 	}
+	info.PrimaryKey, info.Subkeys = keymgr.DescribeKey(k)
+	info.UserIdDetails = keymgr.DescribeUserIds(k)
+	if photo := keymgr.PrimaryPhoto(k); photo != nil {
+		info.UserImage = base64.StdEncoding.EncodeToString(photo.Data)
+		info.UserImageType = photo.MimeType
+	}
 
 	info.KeyData, _ = keymgr.ArmorPublicKey(k)
 }
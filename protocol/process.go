@@ -103,6 +103,11 @@ func processOutgoingStatus(m *pgpmail.Message, status *pgpmail.EncryptStatus, re
 	}
 	if status.Code == pgpmail.StatusFailedNeedPubkeys {
 		result.MissingKeyAddresses = status.MissingKeys
+		for _, addr := range status.MissingKeys {
+			if nerr := keymgr.UnusableKeys(addr, false); nerr != nil {
+				result.UnusableKeys = append(result.UnusableKeys, nerr)
+			}
+		}
 	}
 	if status.Message != nil {
 		result.EmailBody = status.Message.String()
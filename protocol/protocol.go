@@ -5,6 +5,8 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
+	"time"
 
 	"code.google.com/p/go.crypto/openpgp"
 
@@ -47,35 +49,62 @@ type GetKeyInfoResult struct {
 	Fingerprint   string
 	KeyId         string
 	Summary       string
+	Expires       int64 // unix time, zero if the key does not expire
 	UserIDs       []string
-	UserImage     string
+	PrimaryKey    keymgr.KeyDetails
+	Subkeys       []keymgr.KeyDetails
+	UserIdDetails []keymgr.UserIdDetails
+	UserImage     string // base64 encoded primary photo id
+	UserImageType string
 	KeyData       string
 	SecretKeyData string
+	UnusableKeys  []keymgr.SkippedKey // why the keys for Address cannot be used, if none can
 }
 
 func (*Protocol) GetKeyInfo(args GetKeyInfoArgs, result *GetKeyInfoResult) error {
 	logger.Info("Processing GetKeyInfo")
-	if k := handleGetKeyInfo(args.Address, args.KeyId); k != nil {
+	k, unusable := handleGetKeyInfo(args.Address, args.KeyId)
+	if k != nil {
 		populateKeyInfo(k, result)
 	}
+	if unusable != nil {
+		result.UnusableKeys = unusable.Skipped
+	}
 	return nil
 }
 
-func handleGetKeyInfo(address string, keyid string) *openpgp.Entity {
+func handleGetKeyInfo(address string, keyid string) (*openpgp.Entity, *keymgr.NoUsableKeyError) {
 	if address != "" {
 		return getEntityByEmail(address)
 	} else if keyid != "" {
-		return getEntityByKeyId(keyid)
+		return getEntityByKeyId(keyid), nil
 	}
-	return nil
+	return nil, nil
 }
 
-func getEntityByEmail(email string) *openpgp.Entity {
-	if k, _ := keymgr.KeySource().GetSecretKey(email); k != nil {
-		return k
+// getEntityByEmail returns the key to use for email. If none of the keys
+// for email can be used one of them is returned along with the reasons.
+func getEntityByEmail(email string) (*openpgp.Entity, *keymgr.NoUsableKeyError) {
+	ks := keymgr.KeySource()
+	if k, _ := ks.GetSecretKey(email); k != nil {
+		return k, nil
+	}
+	if k, _ := ks.GetPublicKey(email); k != nil {
+		return k, nil
+	}
+	nerr := keymgr.UnusableKeys(email, false)
+	if nerr == nil {
+		return nil, nil
 	}
-	k, _ := keymgr.KeySource().GetPublicKey(email)
-	return k
+	// report unusable keys rather than none at all
+	logger.Info(nerr.Error())
+	if el, _ := ks.GetAllSecretKeys(email); len(el) > 0 {
+		return el[0], nerr
+	}
+	if el, _ := ks.GetAllPublicKeys(email); len(el) > 0 {
+		return el[0], nerr
+	}
+	return nil, nerr
 }
 
 func getEntityByKeyId(keyId string) *openpgp.Entity {
@@ -90,6 +119,46 @@ func getEntityByKeyId(keyId string) *openpgp.Entity {
 	return keymgr.KeySource().GetPublicKeyById(id)
 }
 
+//
+// Protocol.ListKeys
+//
+
+// Query matches a substring of a user id, email address, key id or
+// fingerprint. Filter is "", "public", "secret", "expired" or "revoked",
+// SortBy is "name" or "created". Limit defaults to 50 and is at most 500.
+type ListKeysArgs struct {
+	Query      string
+	Filter     string
+	SortBy     string
+	Descending bool
+	Offset     int
+	Limit      int
+}
+
+// ListKeysResult holds one page of keys, Total counts all matching keys.
+type ListKeysResult struct {
+	Keys  []keymgr.KeyListing
+	Total int
+}
+
+func (*Protocol) ListKeys(args ListKeysArgs, result *ListKeysResult) error {
+	logger.Info("Processing ListKeys")
+	list, err := keymgr.ListKeys(keymgr.ListOptions{
+		Query:      args.Query,
+		Filter:     args.Filter,
+		SortBy:     args.SortBy,
+		Descending: args.Descending,
+		Offset:     args.Offset,
+		Limit:      args.Limit,
+	})
+	if err != nil {
+		return err
+	}
+	result.Keys = list.Keys
+	result.Total = list.Total
+	return nil
+}
+
 //
 // Protocol.ProcessIncoming
 //
@@ -134,6 +203,7 @@ type ProcessOutgoingResult struct {
 	EmailBody           string
 	FailureMessage      string
 	MissingKeyAddresses []string
+	UnusableKeys        []*keymgr.NoUsableKeyError // why the keys of missing addresses cannot be used
 }
 
 func (*Protocol) ProcessOutgoing(args ProcessOutgoingArgs, result *ProcessOutgoingResult) error {
@@ -173,6 +243,389 @@ func (*Protocol) UnlockPrivateKey(args UnlockPrivateKeyArgs, result *bool) error
 	return nil
 }
 
+//
+// Protocol.ChangePassphrase
+//
+
+type ChangePassphraseArgs struct {
+	KeyId            string
+	OldPassphrase    string
+	NewPassphrase    string
+	RemoveProtection bool
+}
+
+func (*Protocol) ChangePassphrase(args ChangePassphraseArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing ChangePassphrase")
+	id, err := decodeKeyId(args.KeyId)
+	if err != nil {
+		return err
+	}
+	k := keymgr.KeySource().GetSecretKeyById(id)
+	if k == nil {
+		return errors.New("No key found for given KeyId")
+	}
+	e, err := keymgr.ChangePassphrase(k.PrimaryKey.Fingerprint, []byte(args.OldPassphrase), []byte(args.NewPassphrase), args.RemoveProtection)
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, result)
+	return nil
+}
+
+//
+// Protocol.AddSubkey
+//
+
+// Usage is "sign", "encrypt" or "authenticate". ExpiresAfter is in
+// seconds, zero for a subkey which does not expire.
+type AddSubkeyArgs struct {
+	KeyId        string
+	Usage        string
+	Algorithm    string
+	KeySize      int
+	Curve        string
+	ExpiresAfter int64
+	Passphrase   string
+}
+
+func (*Protocol) AddSubkey(args AddSubkeyArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing AddSubkey")
+	k, err := getSecretKeyById(args.KeyId)
+	if err != nil {
+		return err
+	}
+	lifetime, err := decodeLifetime(args.ExpiresAfter)
+	if err != nil {
+		return err
+	}
+	params := &keymgr.KeyParams{
+		Algorithm: args.Algorithm,
+		Bits:      args.KeySize,
+		Curve:     args.Curve,
+		Lifetime:  lifetime,
+	}
+	e, err := keymgr.AddSubkey(k.PrimaryKey.Fingerprint, args.Usage, params, []byte(args.Passphrase))
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, result)
+	return nil
+}
+
+//
+// Protocol.RotateEncryptionSubkey
+//
+
+// Overlap is how many seconds the old encryption subkeys stay valid,
+// keymgr.DefaultRotationOverlap if it is zero.
+type RotateEncryptionSubkeyArgs struct {
+	KeyId        string
+	KeySize      int
+	ExpiresAfter int64
+	Overlap      int64
+	Passphrase   string
+}
+
+func (*Protocol) RotateEncryptionSubkey(args RotateEncryptionSubkeyArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing RotateEncryptionSubkey")
+	k, err := getSecretKeyById(args.KeyId)
+	if err != nil {
+		return err
+	}
+	lifetime, err := decodeLifetime(args.ExpiresAfter)
+	if err != nil {
+		return err
+	}
+	overlap, err := decodeDuration("Overlap", args.Overlap)
+	if err != nil {
+		return err
+	}
+	if overlap == 0 {
+		overlap = keymgr.DefaultRotationOverlap
+	}
+	params := &keymgr.KeyParams{
+		Bits:     args.KeySize,
+		Lifetime: lifetime,
+	}
+	e, err := keymgr.RotateEncryptionSubkey(k.PrimaryKey.Fingerprint, params, overlap, []byte(args.Passphrase))
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, result)
+	return nil
+}
+
+//
+// Protocol.SetExpiration
+//
+
+// Expires is a unix time, zero to remove the expiration. It is set for
+// the primary key if PrimaryKey is set or no SubkeyIds are given, and for
+// the subkeys in SubkeyIds.
+type SetExpirationArgs struct {
+	KeyId      string
+	Expires    int64
+	PrimaryKey bool
+	SubkeyIds  []string
+	Passphrase string
+}
+
+func (*Protocol) SetExpiration(args SetExpirationArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing SetExpiration")
+	k, err := getSecretKeyById(args.KeyId)
+	if err != nil {
+		return err
+	}
+	var subkeyIds []uint64
+	for _, s := range args.SubkeyIds {
+		id, err := decodeKeyId(s)
+		if err != nil {
+			return err
+		}
+		subkeyIds = append(subkeyIds, id)
+	}
+	var expires time.Time
+	if args.Expires != 0 {
+		expires = time.Unix(args.Expires, 0)
+	}
+	primary := args.PrimaryKey || len(subkeyIds) == 0
+	e, err := keymgr.SetExpiration(k.PrimaryKey.Fingerprint, expires, primary, subkeyIds, []byte(args.Passphrase))
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, result)
+	return nil
+}
+
+//
+// Protocol.RevokeKey
+//
+
+// Reason is one of the reason codes of RFC 4880 section 5.2.3.23, see
+// keymgr.ReasonNone and following. The passphrase is only needed if the
+// secret key is locked.
+type RevokeKeyArgs struct {
+	KeyId      string
+	Reason     int
+	ReasonText string
+	Passphrase string
+}
+
+func (*Protocol) RevokeKey(args RevokeKeyArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing RevokeKey")
+	k, err := getSecretKeyById(args.KeyId)
+	if err != nil {
+		return err
+	}
+	e, err := keymgr.RevokeKey(k.PrimaryKey.Fingerprint, args.Reason, args.ReasonText, []byte(args.Passphrase))
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, result)
+	return nil
+}
+
+//
+// Protocol.RevokeSubkey
+//
+
+type RevokeSubkeyArgs struct {
+	KeyId      string
+	SubkeyId   string
+	Reason     int
+	ReasonText string
+	Passphrase string
+}
+
+func (*Protocol) RevokeSubkey(args RevokeSubkeyArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing RevokeSubkey")
+	k, err := getSecretKeyById(args.KeyId)
+	if err != nil {
+		return err
+	}
+	subkeyId, err := decodeKeyId(args.SubkeyId)
+	if err != nil {
+		return err
+	}
+	e, err := keymgr.RevokeSubkey(k.PrimaryKey.Fingerprint, subkeyId, args.Reason, args.ReasonText, []byte(args.Passphrase))
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, result)
+	return nil
+}
+
+//
+// Protocol.AddUserId
+//
+
+type AddUserIdArgs struct {
+	KeyId      string
+	RealName   string
+	Email      string
+	Comment    string
+	Passphrase string
+}
+
+func (*Protocol) AddUserId(args AddUserIdArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing AddUserId")
+	k, err := getSecretKeyById(args.KeyId)
+	if err != nil {
+		return err
+	}
+	e, err := keymgr.AddUserId(k.PrimaryKey.Fingerprint, args.RealName, args.Comment, args.Email, []byte(args.Passphrase))
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, result)
+	return nil
+}
+
+//
+// Protocol.AddPhotoId
+//
+
+// Image is the JPEG image data, base64 encoded in the request.
+type AddPhotoIdArgs struct {
+	KeyId      string
+	Image      []byte
+	Passphrase string
+}
+
+func (*Protocol) AddPhotoId(args AddPhotoIdArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing AddPhotoId")
+	k, err := getSecretKeyById(args.KeyId)
+	if err != nil {
+		return err
+	}
+	e, err := keymgr.AddPhotoId(k.PrimaryKey.Fingerprint, args.Image, []byte(args.Passphrase))
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, result)
+	return nil
+}
+
+//
+// Protocol.SetPrimaryUserId
+//
+
+type SetPrimaryUserIdArgs struct {
+	KeyId      string
+	UserId     string
+	Passphrase string
+}
+
+func (*Protocol) SetPrimaryUserId(args SetPrimaryUserIdArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing SetPrimaryUserId")
+	k, err := getSecretKeyById(args.KeyId)
+	if err != nil {
+		return err
+	}
+	e, err := keymgr.SetPrimaryUserId(k.PrimaryKey.Fingerprint, args.UserId, []byte(args.Passphrase))
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, result)
+	return nil
+}
+
+//
+// Protocol.RevokeUserId
+//
+
+type RevokeUserIdArgs struct {
+	KeyId      string
+	UserId     string
+	Reason     int
+	ReasonText string
+	Passphrase string
+}
+
+func (*Protocol) RevokeUserId(args RevokeUserIdArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing RevokeUserId")
+	k, err := getSecretKeyById(args.KeyId)
+	if err != nil {
+		return err
+	}
+	e, err := keymgr.RevokeUserId(k.PrimaryKey.Fingerprint, args.UserId, args.Reason, args.ReasonText, []byte(args.Passphrase))
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, result)
+	return nil
+}
+
+func getSecretKeyById(keyId string) (*openpgp.Entity, error) {
+	id, err := decodeKeyId(keyId)
+	if err != nil {
+		return nil, err
+	}
+	k := keymgr.KeySource().GetSecretKeyById(id)
+	if k == nil {
+		return nil, errors.New("No key found for given KeyId")
+	}
+	return k, nil
+}
+
+//
+// Protocol.DeleteKey
+//
+
+type DeleteKeyArgs struct {
+	Fingerprint string
+}
+
+func (*Protocol) DeleteKey(args DeleteKeyArgs, result *bool) error {
+	logger.Info("Processing DeleteKey")
+	fp, err := decodeFingerprint(args.Fingerprint)
+	if err != nil {
+		return err
+	}
+	if err := keymgr.DeleteKey(fp); err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+//
+// Protocol.DeleteSecretKey
+//
+
+// DeleteSecretKeyArgs requires Confirm to be set since the secret key
+// cannot be recovered once it is deleted.
+type DeleteSecretKeyArgs struct {
+	Fingerprint string
+	Confirm     bool
+}
+
+func (*Protocol) DeleteSecretKey(args DeleteSecretKeyArgs, result *bool) error {
+	logger.Info("Processing DeleteSecretKey")
+	fp, err := decodeFingerprint(args.Fingerprint)
+	if err != nil {
+		return err
+	}
+	if err := keymgr.DeleteSecretKey(fp, args.Confirm); err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+func decodeFingerprint(fingerprint string) ([20]byte, error) {
+	var fp [20]byte
+	bs, err := hex.DecodeString(fingerprint)
+	if err != nil {
+		return fp, err
+	}
+	if len(bs) != len(fp) {
+		return fp, fmt.Errorf("fingerprint is not 20 bytes as expected, got %d", len(bs))
+	}
+	copy(fp[:], bs)
+	return fp, nil
+}
+
 func decodeKeyId(keyId string) (uint64, error) {
 	bs, err := hex.DecodeString(keyId)
 	if err != nil {
@@ -184,6 +637,24 @@ func decodeKeyId(keyId string) (uint64, error) {
 	return binary.BigEndian.Uint64(bs), nil
 }
 
+// decodeLifetime converts an ExpiresAfter argument in seconds to a
+// lifetime, zero for a key which does not expire.
+func decodeLifetime(seconds int64) (time.Duration, error) {
+	return decodeDuration("ExpiresAfter", seconds)
+}
+
+// decodeDuration converts the argument called name from seconds to a
+// duration.
+func decodeDuration(name string, seconds int64) (time.Duration, error) {
+	if seconds < 0 {
+		return 0, fmt.Errorf("%s must not be negative, got %d", name, seconds)
+	}
+	if seconds > int64(math.MaxInt64/time.Second) {
+		return 0, fmt.Errorf("%s is too large, got %d", name, seconds)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
 //
 // Protocol.GenerateKeys
 //
@@ -191,11 +662,64 @@ type GenerateKeysArgs struct {
 	RealName string
 	Email    string
 	Comment  string
+
+	// Optional key parameters, see keymgr.KeyParams. ExpiresAfter is
+	// in seconds, zero for a key which does not expire.
+	Algorithm     string
+	KeySize       int
+	Curve         string
+	SigningSubkey bool
+	ExpiresAfter  int64
+	Ciphers       []string
+	Hashes        []string
+	Compression   []string
+	Passphrase    string
+}
+
+// GenerateKeysResult carries the revocation certificate made for the new
+// key, which is also stored in ~/.nyms/revocs.
+type GenerateKeysResult struct {
+	GetKeyInfoResult
+	RevocationCertificate string
 }
 
-func (*Protocol) GenerateKeys(args GenerateKeysArgs, result *GetKeyInfoResult) error {
+func (*Protocol) GenerateKeys(args GenerateKeysArgs, result *GenerateKeysResult) error {
 	logger.Info("Processing GenerateKeys")
-	e, err := keymgr.GenerateNewKey(args.RealName, args.Comment, args.Email)
+	lifetime, err := decodeLifetime(args.ExpiresAfter)
+	if err != nil {
+		return err
+	}
+	params := &keymgr.KeyParams{
+		Algorithm:     args.Algorithm,
+		Bits:          args.KeySize,
+		Curve:         args.Curve,
+		SigningSubkey: args.SigningSubkey,
+		Lifetime:      lifetime,
+		Ciphers:       args.Ciphers,
+		Hashes:        args.Hashes,
+		Compression:   args.Compression,
+		Passphrase:    []byte(args.Passphrase),
+	}
+	e, err := keymgr.GenerateKey(args.RealName, args.Comment, args.Email, params)
+	if err != nil {
+		return err
+	}
+	populateKeyInfo(e, &result.GetKeyInfoResult)
+	result.RevocationCertificate, err = keymgr.RevocationCertificate(e.PrimaryKey.Fingerprint)
+	return err
+}
+
+//
+// Protocol.ImportRevocation
+//
+
+type ImportRevocationArgs struct {
+	Certificate string
+}
+
+func (*Protocol) ImportRevocation(args ImportRevocationArgs, result *GetKeyInfoResult) error {
+	logger.Info("Processing ImportRevocation")
+	e, err := keymgr.ImportRevocation([]byte(args.Certificate))
 	if err != nil {
 		return err
 	}
@@ -203,6 +727,109 @@ func (*Protocol) GenerateKeys(args GenerateKeysArgs, result *GetKeyInfoResult) e
 	return nil
 }
 
+//
+// Protocol.ImportKeys
+//
+
+type ImportKeysArgs struct {
+	// KeyData holds armored key blocks and BinaryKeyData binary ones,
+	// which are base64 encoded in the request.
+	KeyData       string
+	BinaryKeyData []byte
+}
+
+type ImportKeysResult struct {
+	Keys []keymgr.ImportResult
+}
+
+func (*Protocol) ImportKeys(args ImportKeysArgs, result *ImportKeysResult) error {
+	logger.Info("Processing ImportKeys")
+	for _, data := range [][]byte{[]byte(args.KeyData), args.BinaryKeyData} {
+		if len(data) == 0 {
+			continue
+		}
+		keys, err := keymgr.ImportKeys(data)
+		result.Keys = append(result.Keys, keys...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Protocol.ExportKeys
+//
+
+type ExportKeysArgs struct {
+	// Keys are key ids, fingerprints or email addresses, at least one
+	// is required
+	Keys    []string
+	Secret  bool
+	Armor   bool
+	Minimal bool
+	Clean   bool
+}
+
+type ExportKeysResult struct {
+	// KeyData holds the armored keys, BinaryKeyData the binary keys if
+	// armor was not requested.
+	KeyData       string
+	BinaryKeyData []byte
+}
+
+func (*Protocol) ExportKeys(args ExportKeysArgs, result *ExportKeysResult) error {
+	logger.Info("Processing ExportKeys")
+	opts := keymgr.ExportOptions{
+		Secret:  args.Secret,
+		Armor:   args.Armor,
+		Minimal: args.Minimal,
+		Clean:   args.Clean,
+	}
+	data, err := keymgr.ExportKeys(args.Keys, opts)
+	if err != nil {
+		return err
+	}
+	if args.Armor {
+		result.KeyData = string(data)
+	} else {
+		result.BinaryKeyData = data
+	}
+	return nil
+}
+
+//
+// Protocol.GetKeyringDiagnostics
+//
+
+type GetKeyringDiagnosticsResult struct {
+	Diagnostics []keymgr.KeyDiagnostic
+}
+
+func (*Protocol) GetKeyringDiagnostics(_ VoidArg, result *GetKeyringDiagnosticsResult) error {
+	logger.Info("Processing GetKeyringDiagnostics")
+	result.Diagnostics = keymgr.Diagnostics()
+	return nil
+}
+
+//
+// Protocol.CompactKeyrings
+//
+
+type CompactKeyringsResult struct {
+	PacketsRemoved int
+}
+
+func (*Protocol) CompactKeyrings(_ VoidArg, result *CompactKeyringsResult) error {
+	logger.Info("Processing CompactKeyrings")
+	n, err := keymgr.CompactKeyrings()
+	if err != nil {
+		return err
+	}
+	result.PacketsRemoved = n
+	return nil
+}
+
 func catchPanic(err *error, fname string) {
 	if r := recover(); r != nil {
 		msg := fmt.Sprintf("PANIC! caught from function %s : %s", fname, r)